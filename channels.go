@@ -0,0 +1,336 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"fyne.io/fyne/v2"
+)
+
+const (
+	prefFavouritesKey   = "channels.favourites"
+	prefOrderKey        = "channels.order"
+	prefKeysMigratedKey = "channels.keysmigrated" // the servers whose direct message keys have been marked
+
+	archivedSection   = "Archived"
+	channelsSection   = "Channels"
+	directSection     = "Direct messages"
+	favouritesSection = "Favourites"
+	groupsSection     = "Groups"
+)
+
+// channelFlag is a setting the user can turn on for a channel, the channels that have it are saved for each
+// login in the preference of the same name.
+type channelFlag string
+
+const (
+	flagArchived channelFlag = "channels.archived" // moved to the archived section at the bottom
+	flagHidden   channelFlag = "channels.hidden"   // left out of the channel list unless hidden channels are shown
+	flagMuted    channelFlag = "channels.muted"    // left out of the inbox and shown dimmed
+	flagPinned   channelFlag = "channels.pinned"   // shown at the top of its section
+)
+
+var (
+	channelListsLock sync.Mutex
+	channelLists     = make(map[string][]string) // lists of channel keys for each login and preference, read when first needed
+)
+
+// channelSection is a group of channels shown under one heading in the channel list.
+// The channels of a server that have no category are in a section with no name.
+type channelSection struct {
+	name     string
+	channels []*channel
+}
+
+// key identifies the channel among all the channels of its login.
+func (c *channel) key() string {
+	return channelKey(c.server.id, c.id, c.direct)
+}
+
+// channelKey returns the key of the channel with id on the server with srvID. Direct messages are marked,
+// as some services, such as Telegram, number people and groups separately so their ids can be the same.
+func channelKey(srvID, id string, direct bool) string {
+	if direct {
+		return srvID + "/@" + id
+	}
+	return srvID + "/" + id
+}
+
+// isFavourite returns true if the user added the channel to the favourites section of its server.
+func (c *channel) isFavourite() bool {
+	return c.inList(prefFavouritesKey)
+}
+
+// setFavourite adds the channel to the end of the favourites or removes it, remembering the choice.
+func (c *channel) setFavourite(fav bool) {
+	c.setInList(prefFavouritesKey, fav)
+}
+
+// hasFlag returns true if the user turned on the setting f for the channel.
+func (c *channel) hasFlag(f channelFlag) bool {
+	return c.inList(string(f))
+}
+
+// setFlag turns the setting f on or off for the channel, remembering the choice in the preferences of its login.
+func (c *channel) setFlag(f channelFlag, on bool) {
+	setKeyFlag(c.server.login, c.key(), f, on)
+}
+
+// setKeyFlag turns the setting f on or off for the channel with key in login, which does not need to be loaded yet.
+// Services use it to apply the settings they sync.
+func setKeyFlag(login, key string, f channelFlag, on bool) {
+	channelListsLock.Lock()
+	defer channelListsLock.Unlock()
+	setKeyInList(login, key, string(f), on)
+}
+
+func (c *channel) inList(pref string) bool {
+	channelListsLock.Lock()
+	defer channelListsLock.Unlock()
+	return indexOf(channelList(c.server.login, pref), c.key()) >= 0
+}
+
+func (c *channel) setInList(pref string, in bool) {
+	channelListsLock.Lock()
+	defer channelListsLock.Unlock()
+	setKeyInList(c.server.login, c.key(), pref, in)
+}
+
+// setKeyInList adds or removes key at the end of the list in pref, the lock must be held.
+func setKeyInList(login, key, pref string, in bool) {
+	list := channelList(login, pref)
+	i := indexOf(list, key)
+	if in && i < 0 {
+		list = append(list, key)
+	} else if !in && i >= 0 {
+		list = append(list[:i:i], list[i+1:]...)
+	} else {
+		return
+	}
+	setChannelList(login, pref, list)
+}
+
+// channelList returns the channel keys saved in pref for a login, loading them the first time.
+// The lock must be held.
+func channelList(login, pref string) []string {
+	if list, ok := channelLists[login+pref]; ok {
+		return list
+	}
+
+	var list []string
+	if login != "" {
+		list = fyne.CurrentApp().Preferences().StringList(login + pref)
+	}
+	channelLists[login+pref] = list
+	return list
+}
+
+// setChannelList saves the channel keys for a login in pref, the lock must be held.
+func setChannelList(login, pref string, list []string) {
+	channelLists[login+pref] = list
+	if login != "" {
+		fyne.CurrentApp().Preferences().SetStringList(login+pref, list)
+	}
+}
+
+func indexOf(list []string, key string) int {
+	for i, k := range list {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// migrateChannelKeys moves the settings that direct messages of srv saved before their keys were marked over to
+// the new keys, it should be called once the service has listed all the channels of srv.
+// Where a group has the same id the old key is left to the group, as we cannot tell whose it was.
+// Each server is only migrated once, so that settings saved for a group later are not taken.
+func migrateChannelKeys(srv *server) {
+	channelListsLock.Lock()
+	defer channelListsLock.Unlock()
+	done := channelList(srv.login, prefKeysMigratedKey)
+	if indexOf(done, srv.id) >= 0 {
+		return
+	}
+
+	groups := make(map[string]bool)
+	for _, c := range srv.channels {
+		if !c.direct {
+			groups[c.id] = true
+		}
+	}
+	moved := make(map[string]string)
+	for _, c := range srv.channels {
+		if c.direct && !groups[c.id] {
+			moved[channelKey(srv.id, c.id, false)] = c.key()
+		}
+	}
+	moveChannelKeys(srv.login, moved)
+	setChannelList(srv.login, prefKeysMigratedKey, append(done, srv.id))
+}
+
+// migrateChannelKey moves the settings saved for the direct channel c before keys were marked over to its key.
+// It is for services that add chats as they are seen, where a direct message never has the id of a group.
+func migrateChannelKey(c *channel) {
+	if !c.direct {
+		return
+	}
+
+	channelListsLock.Lock()
+	defer channelListsLock.Unlock()
+	moveChannelKeys(c.server.login, map[string]string{channelKey(c.server.id, c.id, false): c.key()})
+}
+
+// moveChannelKeys replaces the old keys in moved with their new keys in each channel list, the lock must be held.
+func moveChannelKeys(login string, moved map[string]string) {
+	for _, pref := range []string{prefFavouritesKey, prefOrderKey, string(flagArchived), string(flagHidden),
+		string(flagMuted), string(flagPinned)} {
+		list := channelList(login, pref)
+		changed := false
+		for i, k := range list {
+			if key, ok := moved[k]; ok {
+				list[i] = key
+				changed = true
+			}
+		}
+		if changed {
+			setChannelList(login, pref, list)
+		}
+	}
+}
+
+// channelSections groups the channels of srv for the channel list: favourites first, then channels without a
+// category, then each category in the order the service listed them and finally those archived.
+// Pinned channels lead their section, the others keep the order the user dragged them into and those never moved
+// follow in the order of the service. Hidden channels are left out unless showHidden is set.
+func channelSections(srv *server, showHidden bool) []channelSection {
+	channelListsLock.Lock()
+	favs := channelList(srv.login, prefFavouritesKey)
+	order := channelList(srv.login, prefOrderKey)
+	hidden := channelList(srv.login, string(flagHidden))
+	archived := channelList(srv.login, string(flagArchived))
+	pinned := channelList(srv.login, string(flagPinned))
+	channelListsLock.Unlock()
+
+	var fav, archive []*channel
+	sections := []channelSection{{}}
+	for _, c := range sortedChannels(srv.channels, order) {
+		switch {
+		case !showHidden && indexOf(hidden, c.key()) >= 0:
+			continue
+		case indexOf(archived, c.key()) >= 0:
+			archive = append(archive, c)
+			continue
+		case indexOf(favs, c.key()) >= 0:
+			fav = append(fav, c)
+			continue
+		}
+
+		found := false
+		for i := range sections {
+			if sections[i].name == c.category {
+				sections[i].channels = append(sections[i].channels, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			sections = append(sections, channelSection{name: c.category, channels: []*channel{c}})
+		}
+	}
+
+	if len(fav) > 0 {
+		sections = append([]channelSection{{name: favouritesSection, channels: sortedChannels(fav, favs)}},
+			sections...)
+	}
+	if len(archive) > 0 {
+		sections = append(sections, channelSection{name: archivedSection, channels: archive})
+	}
+	for _, s := range sections {
+		sort.SliceStable(s.channels, func(i, j int) bool {
+			return indexOf(pinned, s.channels[i].key()) >= 0 && indexOf(pinned, s.channels[j].key()) < 0
+		})
+	}
+	return sections
+}
+
+// sortedChannels returns list ordered by the keys in order, channels missing from it go after in their own order.
+func sortedChannels(list []*channel, order []string) []*channel {
+	rank := func(i int) int {
+		if pos := indexOf(order, list[i].key()); pos >= 0 {
+			return pos
+		}
+		return len(order) + i
+	}
+
+	ranks := make(map[*channel]int, len(list))
+	for i, c := range list {
+		ranks[c] = rank(i)
+	}
+	sorted := append([]*channel{}, list...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return ranks[sorted[i]] < ranks[sorted[j]]
+	})
+	return sorted
+}
+
+// moveChannel saves ch in the place of target, which must be in the same section, moving the others along.
+func moveChannel(ch, target *channel) {
+	pref := prefOrderKey
+	if ch.isFavourite() {
+		pref = prefFavouritesKey
+	}
+
+	channelListsLock.Lock()
+	defer channelListsLock.Unlock()
+	keys := channelList(ch.server.login, pref)
+	var list []*channel
+	if pref == prefOrderKey {
+		list = sortedChannels(ch.server.channels, keys)
+	} else {
+		for _, c := range ch.server.channels {
+			if indexOf(keys, c.key()) >= 0 {
+				list = append(list, c)
+			}
+		}
+		list = sortedChannels(list, keys)
+	}
+
+	from, to := -1, -1
+	for i, c := range list {
+		if c == ch {
+			from = i
+		} else if c == target {
+			to = i
+		}
+	}
+	if from < 0 || to < 0 {
+		return
+	}
+	// moving down target shifts up one when ch is removed, so inserting at to puts ch after it
+	list = append(list[:from:from], list[from+1:]...)
+	list = append(list[:to:to], append([]*channel{ch}, list[to:]...)...)
+
+	// keep keys from other servers of this login
+	var saved []string
+	for _, k := range keys {
+		if c := findKey(ch.server, k); c == nil {
+			saved = append(saved, k)
+		}
+	}
+	for _, c := range list {
+		saved = append(saved, c.key())
+	}
+	setChannelList(ch.server.login, pref, saved)
+}
+
+// findKey returns the channel of srv with the key k, or nil if it is from another server.
+func findKey(srv *server, k string) *channel {
+	for _, c := range srv.channels {
+		if c.key() == k {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+const shrug = `¯\_(ツ)_/¯`
+
+// command is something the user can do by typing /name in the composer.
+// Services can add their own, which replace a built in command of the same name in their channels.
+type command struct {
+	name string
+	args string // how the arguments are written in help, such as "<text>"
+	help string
+
+	// run carries out the command in ch, returning any text that should be shown to the user.
+	// It is called away from the UI goroutine as most commands talk to a server.
+	run func(ch *channel, args string) (string, error)
+}
+
+// builtinCommands returns the commands that work in every channel.
+// Those that need the service to do something report that it is not supported unless the service adds its own.
+func (u *ui) builtinCommands() []*command {
+	return []*command{
+		{name: "help", help: "List the commands you can use here",
+			run: func(ch *channel, _ string) (string, error) {
+				u.showCommandHelp(ch)
+				return "", nil
+			}},
+		{name: "me", args: "<action>", help: "Send an action, such as /me waves",
+			run: func(ch *channel, args string) (string, error) {
+				if args == "" {
+					return "", errors.New("say what you are doing, such as /me waves")
+				}
+				u.outbox.add(ch, "*"+args+"*")
+				return "", nil
+			}},
+		{name: "shrug", args: "[text]", help: "Send " + shrug + " after your text",
+			run: func(ch *channel, args string) (string, error) {
+				u.outbox.add(ch, strings.TrimSpace(args+" "+shrug))
+				return "", nil
+			}},
+		{name: "join", args: "<channel or link>", help: "Open a channel on this server by name, or join with an invite",
+			run: func(ch *channel, args string) (string, error) {
+				name := strings.ToLower(strings.TrimPrefix(args, "#"))
+				for _, c := range ch.server.channels {
+					if strings.ToLower(strings.TrimPrefix(c.name, "#")) == name {
+						u.openChannel(c)
+						return "", nil
+					}
+				}
+				if ch.server.service == nil || args == "" {
+					return "", fmt.Errorf("there is no channel called %s on %s", args, ch.server.name)
+				}
+
+				joined, err := ch.server.service.join(args)
+				if err != nil {
+					return "", err
+				}
+				u.showNewChannel(joined)
+				return "", nil
+			}},
+		{name: "part", help: "Leave this channel, or the server if its channels cannot be left on their own",
+			run: func(ch *channel, _ string) (string, error) {
+				if ch.server.service == nil {
+					return notSupported("leave channels")(ch, "")
+				} else if ch.server.leavable {
+					u.confirmLeaveServer(ch.server)
+					return "", nil
+				} else if ch.direct && !ch.group {
+					return "", errors.New("direct messages cannot be left, hide them instead")
+				}
+				return "", ch.server.service.leave(ch)
+			}},
+		{name: "nick", args: "<name>", help: "Change your name", run: notSupported("change your name")},
+		{name: "topic", args: "[topic]", help: "Show or change the topic of this channel",
+			run: notSupported("show channel topics")},
+		{name: "search", args: "<text>", help: "Search messages from every account",
+			run: func(_ *channel, args string) (string, error) {
+				u.showSearch(args)
+				return "", nil
+			}},
+		{name: "mute", help: "Mute or unmute this channel, muted channels are left out of the inbox",
+			run: func(ch *channel, _ string) (string, error) {
+				if u.toggleChannelFlag(ch, flagMuted) {
+					return ch.name + " is muted", nil
+				}
+				return ch.name + " is no longer muted", nil
+			}},
+	}
+}
+
+// notSupported returns a command action that explains the service cannot do something.
+func notSupported(action string) func(*channel, string) (string, error) {
+	return func(ch *channel, _ string) (string, error) {
+		return "", fmt.Errorf("%s cannot %s from here", ch.server.name, action)
+	}
+}
+
+// commandsFor returns the commands that can be used in ch, sorted by name.
+func (u *ui) commandsFor(ch *channel) []*command {
+	byName := make(map[string]*command)
+	for _, c := range u.builtinCommands() {
+		byName[c.name] = c
+	}
+	if ch != nil && ch.server.service != nil {
+		for _, c := range ch.server.service.commands() {
+			byName[c.name] = c
+		}
+	}
+
+	list := make([]*command, 0, len(byName))
+	for _, c := range byName {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// runCommand carries out a line typed as "/name args", showing the result or any error.
+func (u *ui) runCommand(ch *channel, line string) {
+	name, args := line[1:], ""
+	if space := strings.IndexAny(name, " \n"); space >= 0 {
+		name, args = name[:space], strings.TrimSpace(name[space+1:])
+	}
+
+	for _, c := range u.commandsFor(ch) {
+		if c.name != strings.ToLower(name) {
+			continue
+		}
+
+		go func() {
+			out, err := c.run(ch, args)
+			if err != nil {
+				dialog.ShowError(err, u.win)
+			} else if out != "" {
+				dialog.ShowInformation("/"+c.name, out, u.win)
+			}
+		}()
+		return
+	}
+	dialog.ShowError(fmt.Errorf("unknown command /%s, type /help to see the commands you can use", name), u.win)
+}
+
+// showCommandHelp lists the commands that can be used in ch.
+func (u *ui) showCommandHelp(ch *channel) {
+	list := widget.NewForm()
+	for _, c := range u.commandsFor(ch) {
+		help := widget.NewLabel(c.help)
+		help.Wrapping = fyne.TextWrapWord
+		list.Append(strings.TrimSpace("/"+c.name+" "+c.args), help)
+	}
+	d := dialog.NewCustom("Commands", "Close", list, u.win)
+	d.Resize(fyne.NewSize(480, 0))
+	d.Show()
+}
+
+// suggestCommands offers the commands that start with the name being typed at the start of the message.
+func (u *ui) suggestCommands(name string) []completion {
+	var list []completion
+	for _, c := range u.commandsFor(u.replyTarget()) {
+		if strings.HasPrefix(c.name, strings.ToLower(name)) {
+			list = append(list, completion{label: strings.TrimSpace("/"+c.name+" "+c.args) + " — " + c.help,
+				insert: "/" + c.name})
+		}
+	}
+	return list
+}
@@ -10,48 +10,45 @@ import (
 	"fyne.io/fyne/v2/widget"
 )
 
-var (
-	selectedID     string
-	selectedOption service
-	selectedLogin  func(string, fyne.App)
-)
+type loginOption struct {
+	id      string
+	srv     service
+	content fyne.CanvasObject
+	login   func(string, fyne.App)
+}
 
 func (u *ui) addLogin(w fyne.Window, a fyne.App) {
-	content := u.loginContent(a)
+	var selected *loginOption
+	name := widget.NewEntry()
+	name.SetPlaceHolder("Optional, e.g. Work")
+	content := u.loginContent(a, name, func(opt *loginOption) {
+		selected = opt
+	})
 	d := dialog.NewCustomConfirm("Choose server to add", "Log In", "Cancel",
 		content, func(ok bool) {
-			if !ok {
+			if !ok || selected == nil {
 				return
 			}
 
 			count := a.Preferences().Int(prefServerCountKey)
 			prefix := fmt.Sprintf(prefServerPrefix, count)
 			a.Preferences().SetInt(prefServerCountKey, count+1)
-			a.Preferences().SetString(prefix+prefServerTypeKey, selectedID)
-			go selectedLogin(prefix, a)
+			a.Preferences().SetString(prefix+prefServerTypeKey, selected.id)
+			a.Preferences().SetString(prefix+prefServerNameKey, strings.TrimSpace(name.Text))
+			connected = append(connected, selected.srv)
+			go selected.login(prefix, a)
 		}, w)
 
-	d.Resize(fyne.NewSize(375, 240))
+	d.Resize(fyne.NewSize(375, 280))
 	d.Show()
 }
 
-func (u *ui) loginContent(a fyne.App) fyne.CanvasObject {
-	var opts []struct {
-		id      string
-		srv     service
-		content fyne.CanvasObject
-		login   func(string, fyne.App)
-	}
-
+func (u *ui) loginContent(a fyne.App, name *widget.Entry, onSelected func(*loginOption)) fyne.CanvasObject {
+	var opts []*loginOption
 	for id, data := range services {
 		srv := data(a)
 		content, save := srv.configure(u)
-		opts = append(opts, struct {
-			id      string
-			srv     service
-			content fyne.CanvasObject
-			login   func(string, fyne.App)
-		}{id, srv, content, save})
+		opts = append(opts, &loginOption{id: id, srv: srv, content: content, login: save})
 	}
 
 	details := container.NewMax(widget.NewLabel("and add your login details"))
@@ -74,11 +71,21 @@ func (u *ui) loginContent(a fyne.App) fyne.CanvasObject {
 		}
 		details.Refresh()
 
-		selectedID = opt.id
-		selectedOption = opt.srv
-		selectedLogin = opt.login
+		onSelected(opt)
 	}
 
+	account := widget.NewForm(&widget.FormItem{Text: "Account name", Widget: name})
 	return container.NewBorder(nil, nil, list, nil,
-		container.NewBorder(title, nil, nil, nil, details))
+		container.NewBorder(title, account, nil, nil, details))
+}
+
+// accountName returns the name the user chose for the login stored at prefix,
+// or fallback if they did not provide one.
+func accountName(a fyne.App, prefix, fallback string) string {
+	name := a.Preferences().String(prefix + prefServerNameKey)
+	if name == "" {
+		return fallback
+	}
+
+	return name
 }
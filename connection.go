@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+)
+
+const (
+	reconnectBaseDelay   = time.Second
+	reconnectMaxDelay    = 5 * time.Minute
+	reconnectMaxAttempts = 12
+)
+
+// errAuthRequired should be wrapped by services when a connection attempt fails
+// because the stored login is no longer valid, so that we stop retrying.
+var errAuthRequired = errors.New("authentication required")
+
+type connState int
+
+const (
+	stateConnecting connState = iota
+	stateOnline
+	stateReconnecting
+	stateAuthRequired
+	stateFailed
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateConnecting:
+		return "Connecting"
+	case stateOnline:
+		return "Online"
+	case stateReconnecting:
+		return "Reconnecting"
+	case stateAuthRequired:
+		return "Login required"
+	case stateFailed:
+		return "Offline"
+	}
+	return "Unknown"
+}
+
+// connection tracks the state of a login to a service and handles retrying when it drops.
+// A single connection is shared by all the servers that a login provides.
+type connection struct {
+	lock     sync.RWMutex
+	state    connState
+	dial     func() error
+	redial   chan struct{} // wakes a running reconnect loop when dial is replaced
+	retrying bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	changed   func()
+}
+
+func newConnection(changed func()) *connection {
+	return &connection{done: make(chan struct{}), redial: make(chan struct{}, 1), changed: changed}
+}
+
+// close stops any pending reconnect, it should be called when the service disconnects.
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *connection) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *connection) currentState() connState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.state
+}
+
+func (c *connection) setState(s connState) {
+	c.lock.Lock()
+	old := c.state
+	c.state = s
+	c.lock.Unlock()
+
+	if old != s && c.changed != nil {
+		c.changed()
+	}
+}
+
+// dropped marks the connection as lost and starts dialing again with the last dial function used.
+func (c *connection) dropped() {
+	if c.closed() {
+		return
+	}
+
+	c.setState(stateReconnecting)
+	c.retry()
+}
+
+// reconnect calls dial in the background until it succeeds, waiting longer between each failure.
+// If dial returns an error wrapping errAuthRequired, or we run out of attempts, we give up.
+// Calling it again while retrying replaces dial, which is tried straight away with the attempts counted afresh.
+func (c *connection) reconnect(dial func() error) {
+	c.lock.Lock()
+	c.dial = dial
+	if c.retrying {
+		select { // while locked, so that the loop cannot finish without seeing it
+		case c.redial <- struct{}{}:
+		default: // already woken
+		}
+		c.lock.Unlock()
+		return
+	}
+	c.retrying = true
+	c.lock.Unlock()
+
+	go func() {
+		select {
+		case <-c.redial: // we are about to use the newest dial anyway
+		default:
+		}
+		for attempt := 0; ; attempt++ {
+			c.lock.RLock()
+			dial := c.dial
+			c.lock.RUnlock()
+
+			err := dial()
+			if c.closed() {
+				c.lock.Lock()
+				c.retrying = false
+				c.lock.Unlock()
+				return
+			}
+
+			finished, final := true, stateOnline
+			switch {
+			case err == nil:
+			case errors.Is(err, errAuthRequired):
+				fyne.LogError("Login is no longer valid", err)
+				final = stateAuthRequired
+			case attempt+1 >= reconnectMaxAttempts:
+				fyne.LogError("Giving up connecting", err)
+				final = stateFailed
+			default:
+				finished = false
+			}
+			if finished {
+				if c.finish(final) {
+					return
+				}
+				attempt = -1 // dial was replaced while it ran, so try the new one
+				continue
+			}
+
+			fyne.LogError("Connect failed, will retry", err)
+			if c.currentState() != stateConnecting {
+				c.setState(stateReconnecting)
+			}
+			select {
+			case <-time.After(backoffDelay(attempt)):
+			case <-c.redial:
+				attempt = -1 // a new dial function, such as after logging in again, gets all its attempts
+			case <-c.done:
+				c.lock.Lock()
+				c.retrying = false
+				c.lock.Unlock()
+				return
+			}
+		}
+	}()
+}
+
+// finish ends a reconnect loop in state s and returns true, unless reconnect was given a new dial function
+// since the last attempt, in which case it returns false and the loop should carry on.
+func (c *connection) finish(s connState) bool {
+	c.lock.Lock()
+	select {
+	case <-c.redial:
+		c.lock.Unlock()
+		return false
+	default:
+	}
+	c.retrying = false
+	old := c.state
+	c.state = s
+	c.lock.Unlock()
+
+	if old != s && c.changed != nil {
+		c.changed()
+	}
+	return true
+}
+
+// retry starts reconnecting using the last dial function, for example after failing or when the user asks.
+func (c *connection) retry() {
+	c.lock.RLock()
+	dial := c.dial
+	c.lock.RUnlock()
+
+	if dial == nil {
+		return
+	}
+
+	if c.currentState() == stateFailed {
+		c.setState(stateReconnecting)
+	}
+	c.reconnect(dial)
+}
+
+// backoffDelay returns how long to wait before the next connection attempt.
+// The delay doubles each attempt up to a maximum and is randomised so that
+// many clients do not all return at the same moment.
+func backoffDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = reconnectBaseDelay << uint(attempt)
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
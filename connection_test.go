@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 20; attempt++ {
+		limit := reconnectMaxDelay
+		if attempt < 16 && reconnectBaseDelay<<uint(attempt) < limit {
+			limit = reconnectBaseDelay << uint(attempt)
+		}
+
+		for i := 0; i < 50; i++ { // the delay is random, so check it stays in range
+			if got := backoffDelay(attempt); got < limit/2 || got > limit {
+				t.Fatalf("backoffDelay(%d) = %v, want between %v and %v", attempt, got, limit/2, limit)
+			}
+		}
+	}
+}
+
+func TestReconnectNewDial(t *testing.T) {
+	for i := 0; i < 100; i++ { // the second dial can arrive at any point of the first, so try many times
+		c := newConnection(nil)
+		started := make(chan struct{})
+		var replaced atomic.Bool
+		c.reconnect(func() error {
+			close(started)
+			time.Sleep(time.Millisecond)
+			return errAuthRequired
+		})
+		<-started
+		c.reconnect(func() error {
+			replaced.Store(true)
+			return nil
+		})
+
+		deadline := time.Now().Add(time.Second)
+		for c.currentState() != stateOnline && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if !replaced.Load() || c.currentState() != stateOnline {
+			t.Fatalf("new dial function was not used, state is %v", c.currentState())
+		}
+		c.close()
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	c := newConnection(nil)
+	c.reconnect(func() error {
+		return fmt.Errorf("%w: %v", errAuthRequired, errors.New("password changed"))
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for c.currentState() != stateAuthRequired && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := c.currentState(); got != stateAuthRequired {
+		t.Errorf("state is %v, want %v", got, stateAuthRequired)
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
 	"fyne.io/fyne/v2"
 )
 
@@ -11,10 +16,15 @@ type appData struct {
 type server struct {
 	id            string
 	name, iconURL string
+	account       string // the display name of the login this server belongs to
+	login         string // the preference prefix of the login this server belongs to
 	iconResource  fyne.Resource
 	channels      []*channel
 	service       service
+	status        *connection
 	users         map[string]*user
+	emojis        []*customEmoji // the custom emoji that can be sent here, loaded when first needed
+	leavable      bool           // set for servers that are left as a whole, such as Discord guilds
 }
 
 func (s *server) icon() fyne.Resource {
@@ -32,25 +42,254 @@ func (s *server) icon() fyne.Resource {
 	return icon
 }
 
+// sharesService returns true if another login of the same service type as s is connected.
+func (d *appData) sharesService(s *server) bool {
+	for _, other := range d.servers {
+		if other.service != s.service && reflect.TypeOf(other.service) == reflect.TypeOf(s.service) {
+			return true
+		}
+	}
+	return false
+}
+
+// inbox returns the most recent direct messages and mentions from every server, oldest first.
+func (d *appData) inbox(limit int) []*message {
+	var list []*message
+	for _, s := range d.servers {
+		for _, c := range s.channels {
+			for _, m := range c.allMessages() {
+				if m.inInbox() {
+					list = append(list, m)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].sent.Before(list[j].sent)
+	})
+	if len(list) > limit {
+		list = list[len(list)-limit:]
+	}
+	return list
+}
+
 type channel struct {
+	category string // the heading the service lists the channel under, such as a Discord category
 	direct   bool
+	group    bool // set for direct messages between several people, which can be left unlike those with one person
+	voice    bool // set for channels that people talk in, they have no messages
 	id       string
 	name     string
-	messages []*message
+	topic    string     // what the channel is about, if the service told us
+	messages []*message // guarded by lock, as services add to it from their own goroutines
+	lock     sync.RWMutex
 	server   *server
+
+	indexed int       // how many messages have been added to the search index, guarded by lock
+	loaded  bool      // set once the service has been asked for the recent messages
+	members []*member // the people in the channel, loaded from the service when first needed, guarded by lock
+	talking []*user   // the people connected to a voice channel, kept up to date by the service
+
+	lastRead   string  // the id of the newest message when the user last saw the bottom of the channel
+	scroll     float32 // the scroll offset when the user left the channel
+	scrolledUp bool    // set if the user left the channel while reading older messages
+}
+
+// firstUnread returns the message after the one last read in list, or nil if there is none.
+func (c *channel) firstUnread(list []*message) *message {
+	if c.lastRead == "" {
+		return nil
+	}
+
+	for i, m := range list {
+		if m.id != c.lastRead {
+			continue
+		}
+		if i+1 < len(list) && list[i+1].outgoing == nil {
+			return list[i+1]
+		}
+		return nil
+	}
+	return nil
+}
+
+// sourceName describes where the channel is, such as "Telegram › Bob", for when it is shown outside its server.
+func (c *channel) sourceName() string {
+	return c.server.name + " › " + c.name
 }
 
 type message struct {
+	id      string
 	content string
+	sent    time.Time
 	user    *user
+	rich    []richSpan // the content converted from service markup, if the service provides it
+
+	channel   *channel  // the channel this message was added to
+	mentioned bool      // set if the message mentions or replies to the logged in user
+	outgoing  *outgoing // set if this message is waiting in the outbox
+	pinned    bool      // set if the message is pinned in its channel
+	system    bool      // set for events reported by the service, such as calls, rather than something a person wrote
+}
+
+// inInbox returns true if the message should be shown in the unified inbox, which leaves out muted channels.
+func (m *message) inInbox() bool {
+	if m.channel == nil {
+		return m.mentioned
+	}
+	if m.channel.hasFlag(flagMuted) {
+		return false
+	}
+	return m.mentioned || m.channel.direct
+}
+
+// authorName returns the best name we have for the user that sent the message.
+func (m *message) authorName() string {
+	if m.user == nil {
+		if m.system && m.channel != nil { // events that nobody in particular caused
+			return m.channel.server.name
+		}
+		return "(Unknown)"
+	}
+	return m.user.displayName()
+}
+
+// callText describes a call for a system message, such as "Missed video call" or "Outgoing call, 3m20s".
+func callText(video, outgoing, missed bool, length time.Duration) string {
+	kind := "call"
+	if video {
+		kind = "video call"
+	}
+
+	var text string
+	switch {
+	case missed && outgoing:
+		return "Unanswered " + kind
+	case missed:
+		return "Missed " + kind
+	case outgoing:
+		text = "Outgoing " + kind
+	default:
+		text = "Incoming " + kind
+	}
+	if length > 0 {
+		text += ", " + length.Round(time.Second).String()
+	}
+	return text
+}
+
+// appendNew adds the messages in list that the channel does not already have, matching by id.
+// The messages that were added are returned.
+func (c *channel) appendNew(list []*message) []*message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	known := make(map[string]bool, len(c.messages))
+	for _, m := range c.messages {
+		if m.id != "" {
+			known[m.id] = true
+		}
+	}
+
+	var added []*message
+	for _, m := range list {
+		if m.id != "" && known[m.id] {
+			continue
+		}
+		m.channel = c
+		added = append(added, m)
+	}
+	c.messages = append(c.messages, added...)
+	return added
+}
+
+// addHistory adds older messages from list that the channel does not already have, keeping them in the order
+// they were sent. The messages that were added are returned.
+func (c *channel) addHistory(list []*message) []*message {
+	added := c.appendNew(list)
+	c.lock.Lock()
+	sort.SliceStable(c.messages, func(i, j int) bool {
+		return c.messages[i].sent.Before(c.messages[j].sent)
+	})
+	if len(added) > 0 {
+		c.indexed = 0 // older messages are now before the ones indexed, the index ignores those it has
+	}
+	c.lock.Unlock()
+	return added
+}
+
+// unindexed returns the messages that have not been added to the search index, and counts them as added.
+func (c *channel) unindexed() []*message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	list := append([]*message{}, c.messages[c.indexed:]...)
+	c.indexed = len(c.messages)
+	return list
+}
+
+// memberList returns the people in the channel, or nil if they have not been loaded.
+func (c *channel) memberList() []*member {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.members
+}
+
+// setMembers records the people in the channel, replacing the list rather than changing it so that
+// memberList callers can keep using theirs.
+func (c *channel) setMembers(list []*member) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.members = list
+}
+
+// allMessages returns a copy of the messages of the channel, which can be used while services add more.
+func (c *channel) allMessages() []*message {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]*message{}, c.messages...)
 }
 
 type user struct {
+	id                        string // the service id, used to mention the user
 	name, username, avatarURL string
+	presence                  presence
 }
 
-func findChan(d *appData, sID, cID string) *channel {
-	for _, s := range d.servers {
+// presence is whether a user is around to chat, as far as their service tells us.
+type presence int
+
+const (
+	presenceUnknown presence = iota
+	presenceOnline
+	presenceAway
+	presenceBusy
+	presenceOffline
+)
+
+// member is a user in a channel, with any roles they have there.
+type member struct {
+	user  *user
+	roles []string
+}
+
+// displayName returns the best name we have for the user.
+func (u *user) displayName() string {
+	if u.name != "" {
+		return u.name
+	}
+	return u.username
+}
+
+// customEmoji is a picture that a service lets people use like an emoji.
+type customEmoji struct {
+	id, name string
+	alt      string // a standard emoji that the service shows in its place, if any
+	imageURL string
+	animated bool
+}
+
+func findChan(servers []*server, sID, cID string) *channel {
+	for _, s := range servers {
 		if s.id == sID {
 			if c := findServerChan(s, cID); c != nil {
 				return c
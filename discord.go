@@ -1,27 +1,100 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 	"github.com/diamondburned/arikawa/gateway"
 
+	"github.com/diamondburned/arikawa/api"
 	discapi "github.com/diamondburned/arikawa/discord"
 	"github.com/diamondburned/arikawa/session"
+	"github.com/diamondburned/arikawa/utils/httputil"
+	"github.com/diamondburned/arikawa/utils/json/option"
 )
 
-const prefDiscordTokenKey = "auth.token"
+const (
+	prefDiscordTokenKey = "auth.token"
+
+	discordMemberLimit = 1000
+	discordStageVoice  = discapi.ChannelType(13) // stage channels are newer than our library
+)
+
+var (
+	discordMarkup = []markupDelim{{"```", richCodeBlock, false}, {"**", richBold, false}, {"__", richUnderline, false},
+		{"~~", richStrike, false}, {"||", richSpoiler, false}, {"`", richCode, false}, {"*", richItalic, false},
+		{"_", richItalic, true}}
+	discordToken = regexp.MustCompile(`<(@&|@!?|#|(a?):(\w+):)(\d+)>`)
+)
 
 type discord struct {
-	app  fyne.App
-	conn *session.Session
+	app      fyne.App
+	conn     *session.Session
+	me       discapi.UserID
+	status   *connection
+	servers  []*server
+	guilds   sync.Mutex // held while adding a guild, which joining and the gateway can both do
+	ui       *ui
+	dms      *server                                                  // the direct messages we have opened, it is added to servers when first needed
+	presence map[discapi.UserID]presence                              // the last presence the gateway sent for each user, guarded by userLock
+	voice    map[discapi.GuildID]map[discapi.UserID]discapi.ChannelID // who is in each voice channel, guarded by userLock
 }
 
 func initDiscord(a fyne.App) service {
-	return &discord{app: a}
+	return &discord{app: a, presence: make(map[discapi.UserID]presence),
+		voice: make(map[discapi.GuildID]map[discapi.UserID]discapi.ChannelID)}
+}
+
+// commands changes your nickname and the channel topic on Discord servers.
+func (d *discord) commands() []*command {
+	return []*command{
+		{name: "nick", args: "[name]", help: "Change your nickname on this server, or reset it if empty",
+			run: func(ch *channel, args string) (string, error) {
+				if d.conn == nil {
+					return "", errors.New("not connected")
+				}
+				id, _ := strconv.Atoi(ch.server.id)
+				return "", discordError(d.conn.Client.ChangeOwnNickname(discapi.GuildID(id), args))
+			}},
+		{name: "topic", args: "[topic]", help: "Show or change the topic of this channel",
+			run: func(ch *channel, args string) (string, error) {
+				if d.conn == nil {
+					return "", errors.New("not connected")
+				}
+				id, _ := strconv.Atoi(ch.id)
+				if args != "" {
+					return "", discordError(d.conn.Client.ModifyChannel(discapi.ChannelID(id),
+						api.ModifyChannelData{Topic: option.NewNullableString(args)}))
+				}
+
+				c, err := d.conn.Client.Channel(discapi.ChannelID(id))
+				if err != nil {
+					return "", discordError(err)
+				}
+				if c.Topic == "" {
+					return ch.name + " has no topic", nil
+				}
+				return c.Topic, nil
+			}},
+	}
+}
+
+// bio returns nothing as Discord does not share the about me of a user through this API.
+func (d *discord) bio(*user) (string, error) {
+	return "", nil
 }
 
 func (d *discord) configure(u *ui) (fyne.CanvasObject, func(prefix string, a fyne.App)) {
@@ -36,45 +109,220 @@ func (d *discord) configure(u *ui) (fyne.CanvasObject, func(prefix string, a fyn
 }
 
 func (d *discord) disconnect() {
+	if d.status != nil {
+		d.status.close()
+	}
 	if d.conn != nil {
 		_ = d.conn.Close()
 	}
 }
 
 func (d *discord) loadChannels(u *ui) {
-	for _, s := range u.data.servers {
-		id, _ := strconv.Atoi(s.id)
-		cs, _ := d.conn.Client.Channels(discapi.GuildID(id))
-		for _, c := range cs {
-			if c.Type == discapi.GuildCategory || c.Type == discapi.GuildVoice {
-				continue // ignore voice and groupings for now
-			}
-
-			chn := &channel{id: strconv.Itoa(int(c.ID)), name: "#" + c.Name, server: s}
-			if len(s.channels) == 0 {
-				chn.messages = d.loadRecentMessages(c.ID)
-				if s == u.currentServer {
-					u.setChannel(chn)
-				}
+	first := make(map[*server]*channel) // the channel shown when each server is selected, loaded before the rest
+	for _, s := range d.servers {
+		s.channels = append(s.channels, d.guildChannels(s)...)
+		for _, chn := range s.channels {
+			if chn.voice {
+				continue
 			}
-			s.channels = append(s.channels, chn)
+
+			first[s] = chn
+			id, _ := strconv.Atoi(chn.id)
+			added := chn.appendNew(d.loadRecentMessages(s, discapi.ChannelID(id)))
+			if s == u.currentServer {
+				u.setChannel(chn)
+			} else {
+				u.messagesAdded(chn, added)
+			}
+			break
 		}
+		d.updateVoice(s)
 	}
 	u.channels.Refresh()
 
-	for _, s := range u.data.servers {
-		for i, c := range s.channels {
-			if i == 0 {
+	for _, s := range d.servers {
+		for _, c := range s.channels {
+			if c.voice || c == first[s] {
 				continue // we did this one above
 			}
 
 			id, _ := strconv.Atoi(c.id)
-			c.messages = d.loadRecentMessages(discapi.ChannelID(id))
+			u.messagesAdded(c, c.appendNew(d.loadRecentMessages(s, discapi.ChannelID(id))))
 		}
 	}
 }
 
-func (d *discord) loadRecentMessages(id discapi.ChannelID) []*message {
+// guildChannels loads the text and voice channels of guild s, in the order Discord lists them.
+func (d *discord) guildChannels(s *server) []*channel {
+	id, _ := strconv.Atoi(s.id)
+	cs, _ := d.conn.Client.Channels(discapi.GuildID(id))
+	categories := make(map[discapi.ChannelID]string)
+	for _, c := range cs {
+		if c.Type == discapi.GuildCategory {
+			categories[c.ID] = c.Name
+		}
+	}
+
+	var list []*channel
+	for _, c := range cs {
+		if c.Type == discapi.GuildCategory {
+			continue
+		}
+
+		chn := &channel{id: strconv.Itoa(int(c.ID)), name: "#" + c.Name, category: categories[c.CategoryID],
+			topic: c.Topic, server: s}
+		if c.Type == discapi.GuildVoice || c.Type == discordStageVoice {
+			chn.name, chn.voice = c.Name, true
+		}
+		list = append(list, chn)
+	}
+	return list
+}
+
+// addGuild adds a server for a guild joined since we logged in, loading its channels.
+// It returns the server we already have if the guild is known, and false as it was not added.
+func (d *discord) addGuild(g discapi.Guild) (*server, bool) {
+	d.guilds.Lock()
+	defer d.guilds.Unlock()
+	if s := d.guildServer(g.ID); s != nil {
+		return s, false
+	}
+
+	s := &server{service: d, name: g.Name, id: g.ID.String(), iconURL: g.IconURL(), status: d.status,
+		users: make(map[string]*user), leavable: true}
+	if len(d.servers) > 0 {
+		s.account, s.login = d.servers[0].account, d.servers[0].login
+	}
+	s.channels = d.guildChannels(s)
+	for _, c := range s.channels {
+		if !c.voice {
+			id, _ := strconv.Atoi(c.id)
+			c.appendNew(d.loadRecentMessages(s, discapi.ChannelID(id)))
+		}
+	}
+	d.servers = append(d.servers, s)
+	return s, true
+}
+
+// forgetGuild removes the server of a guild we left or were removed from.
+func (d *discord) forgetGuild(s *server) {
+	d.guilds.Lock()
+	for i, srv := range d.servers {
+		if srv == s {
+			d.servers = append(d.servers[:i:i], d.servers[i+1:]...)
+			break
+		}
+	}
+	d.guilds.Unlock()
+	d.ui.removeServer(s)
+}
+
+// join accepts an invite to a guild, given as a link or just the code, returning the channel it invites to.
+func (d *discord) join(invite string) (*channel, error) {
+	if d.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
+	code := invite[strings.LastIndex(invite, "/")+1:]
+	var inv discapi.Invite
+	err := d.conn.Client.RequestJSON(&inv, "POST", api.EndpointInvites+code)
+	if err != nil {
+		return nil, discordError(err)
+	}
+	if inv.Guild == nil {
+		return nil, errors.New("the invite " + code + " is not for a server")
+	}
+
+	s, _ := d.addGuild(*inv.Guild)
+	if ch := findServerChan(s, inv.Channel.ID.String()); ch != nil {
+		return ch, nil
+	}
+	for _, ch := range s.channels {
+		if !ch.voice {
+			return ch, nil
+		}
+	}
+	return nil, errors.New(s.name + " has no channels we can show")
+}
+
+// createGroup starts a group direct message with people, Discord makes up a name from theirs if name is empty.
+func (d *discord) createGroup(name string, people []*user) (*channel, error) {
+	if d.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
+	var ids []string
+	for _, usr := range people {
+		if usr.id != d.me.String() {
+			ids = append(ids, usr.id)
+		}
+	}
+	var c discapi.Channel
+	err := d.conn.Client.RequestJSON(&c, "POST", api.EndpointMe+"/channels",
+		httputil.WithJSONBody(map[string]interface{}{"recipients": ids}))
+	if err != nil {
+		return nil, discordError(err)
+	}
+	if name != "" {
+		if err = d.conn.Client.ModifyChannel(c.ID, api.ModifyChannelData{Name: name}); err != nil {
+			return nil, discordError(err)
+		}
+	} else {
+		names := make([]string, len(people))
+		for i, usr := range people {
+			names[i] = usr.displayName()
+		}
+		name = strings.Join(names, ", ")
+	}
+
+	dms := d.directServer()
+	ch := &channel{id: c.ID.String(), name: name, direct: true, group: true, server: dms}
+	dms.channels = append(dms.channels, ch)
+	return ch, nil
+}
+
+// leave closes a group direct message. Discord has no way to leave just one channel of a guild.
+func (d *discord) leave(ch *channel) error {
+	if d.conn == nil {
+		return errors.New("not connected")
+	}
+	if ch.server != d.dms {
+		return errors.New("Discord channels cannot be left on their own, leave the server " + ch.server.name +
+			" instead")
+	} else if !ch.group {
+		return errors.New("direct messages cannot be left")
+	}
+
+	id, _ := strconv.Atoi(ch.id)
+	if err := d.conn.Client.DeleteChannel(discapi.ChannelID(id)); err != nil {
+		return discordError(err)
+	}
+	d.ui.removeChannel(ch)
+	return nil
+}
+
+// leaveServer leaves the guild of s, removing all of its channels.
+func (d *discord) leaveServer(s *server) error {
+	if d.conn == nil {
+		return errors.New("not connected")
+	} else if !s.leavable {
+		return errors.New(s.name + " cannot be left")
+	}
+
+	id, _ := strconv.Atoi(s.id)
+	if err := d.conn.Client.LeaveGuild(discapi.GuildID(id)); err != nil {
+		return discordError(err)
+	}
+	d.forgetGuild(s)
+	return nil
+}
+
+// history returns nothing more, the recent messages of every channel are loaded when we connect.
+func (d *discord) history(*channel) ([]*message, error) {
+	return nil, nil
+}
+
+func (d *discord) loadRecentMessages(s *server, id discapi.ChannelID) []*message {
 	ms, err := d.conn.Client.Messages(id, 15)
 	if err != nil {
 		return nil
@@ -82,89 +330,645 @@ func (d *discord) loadRecentMessages(id discapi.ChannelID) []*message {
 
 	var list []*message
 	for i := len(ms) - 1; i >= 0; i-- { // newest message is first in response
-		m := ms[i]
-		msg := &message{content: m.Content, user: &user{
-			name:      m.Author.Username,
-			avatarURL: m.Author.AvatarURL()},
-		}
-		list = append(list, msg)
+		list = append(list, d.newMessage(ms[i], s))
 	}
 
 	return list
 }
 
-func (d *discord) loadServers(s *session.Session, u *ui) {
-	d.conn = s
+func (d *discord) newMessage(m discapi.Message, s *server) *message {
+	msg := &message{id: m.ID.String(), content: m.Content, rich: discordRich(m, s), sent: m.Timestamp.Time(),
+		user: d.getUser(m.Author, s), pinned: m.Pinned}
+	for _, mention := range m.Mentions {
+		if mention.ID == d.me {
+			msg.mentioned = true
+		}
+	}
+	if text := discordSystemText(m); text != "" {
+		msg.content, msg.rich, msg.system = text, nil, true
+	}
+	return msg
+}
 
-	var servers []*server
-	gs, err := s.Client.Guilds(0)
-	if err != nil {
-		log.Println("Error getting guilds")
-		return
+// discordSystemText describes a message that Discord sends for an event, such as someone joining,
+// it returns "" for messages that people wrote.
+func discordSystemText(m discapi.Message) string {
+	names := make([]string, len(m.Mentions))
+	for i, u := range m.Mentions {
+		names[i] = u.Username
 	}
-	for _, g := range gs {
-		servers = append(servers, &server{service: d, name: g.Name, id: strconv.Itoa(int(g.ID)), iconURL: g.IconURL()})
+
+	switch m.Type {
+	case discapi.RecipientAddMessage:
+		return "added " + strings.Join(names, ", ")
+	case discapi.RecipientRemoveMessage:
+		if len(m.Mentions) == 1 && m.Mentions[0].ID == m.Author.ID {
+			return "left"
+		}
+		return "removed " + strings.Join(names, ", ")
+	case discapi.CallMessage:
+		return "started a call"
+	case discapi.ChannelNameChangeMessage:
+		return "renamed the channel to " + m.Content
+	case discapi.ChannelIconChangeMessage:
+		return "changed the group photo"
+	case discapi.ChannelPinnedMessage:
+		return "pinned a message"
+	case discapi.GuildMemberJoinMessage:
+		return "joined the server"
+	case discapi.NitroBoostMessage, discapi.NitroTier1Message, discapi.NitroTier2Message, discapi.NitroTier3Message:
+		return "boosted the server"
 	}
+	return ""
+}
 
-	if u.data == nil {
-		u.data = &appData{}
+// channelChanged adds system messages for changes to the name or topic of a guild channel, which Discord only
+// tells us about as an event.
+func (d *discord) channelChanged(c discapi.Channel, u *ui) {
+	ch := findChan(d.servers, c.GuildID.String(), c.ID.String())
+	if ch == nil {
+		return
+	}
+
+	var events []*message
+	if name := "#" + c.Name; !ch.voice && name != ch.name {
+		ch.name = name
+		events = append(events, &message{content: "Channel renamed to " + name, sent: time.Now(), system: true})
+		u.channels.Refresh()
+	}
+	if c.Topic != ch.topic {
+		ch.topic = c.Topic
+		events = append(events, &message{content: "Topic changed to: " + c.Topic, sent: time.Now(), system: true})
 	}
-	u.data.servers = append(u.data.servers, servers...)
-	if len(u.data.servers) > 0 {
-		u.currentServer = u.data.servers[0]
-		u.servers.Select(0)
+	u.messagesAdded(ch, ch.appendNew(events))
+}
+
+// connect opens the session, loading the servers the first time it succeeds.
+// It is used as the dial function for our connection status so may be called many times.
+func (d *discord) connect(s *session.Session, prefix string, u *ui) error {
+	if d.servers == nil {
+		err := d.loadServers(s, prefix, u)
+		if err != nil {
+			return err
+		}
 	}
-	u.servers.Refresh()
 
-	err = s.Open()
+	err := s.Open()
 	if err != nil {
 		log.Println("Error opening session", err)
-		d.conn = nil
-		return
+		return err
+	}
+
+	if d.conn == s {
+		go d.resync(u)
+		return nil
+	}
+	d.conn, d.ui = s, u
+	go d.loadChannels(u)
+	return nil
+}
+
+func (d *discord) loadServers(s *session.Session, prefix string, u *ui) error {
+	me, err := s.Me()
+	if err != nil {
+		return discordError(err)
+	}
+	account := accountName(d.app, prefix, me.Username)
+	d.me = me.ID
+
+	var servers []*server
+	gs, err := s.Client.Guilds(0)
+	if err != nil {
+		log.Println("Error getting guilds")
+		return discordError(err)
+	}
+	for _, g := range gs {
+		servers = append(servers, &server{service: d, name: g.Name, id: strconv.Itoa(int(g.ID)), iconURL: g.IconURL(),
+			account: account, login: prefix, status: d.status, users: make(map[string]*user), leavable: true})
 	}
+	d.servers = servers
+	u.addServers(servers...)
+
+	// the gateway redials by itself if it drops, we just track the state and catch up after
+	s.Gateway.AfterClose = func(err error) {
+		if !d.status.closed() && d.status.currentState() == stateOnline {
+			d.status.setState(stateReconnecting)
+		}
+	}
+	s.AddHandler(func(ev *gateway.ReadyEvent) {
+		for _, g := range ev.UserGuildSettings {
+			applyDiscordSettings(prefix, g)
+		}
+		for _, p := range ev.Presences {
+			d.setPresence(p)
+		}
+		for _, g := range ev.Guilds {
+			for _, p := range g.Presences {
+				d.setPresence(p)
+			}
+		}
+		d.online(u)
+	})
+	s.AddHandler(func(ev *gateway.GuildCreateEvent) {
+		if srv, added := d.addGuild(ev.Guild); added { // joined from another device
+			u.addServers(srv)
+		}
+		for _, p := range ev.Presences {
+			d.setPresence(p)
+		}
+		for _, v := range ev.VoiceStates {
+			d.setVoiceState(ev.ID, v)
+		}
+		if srv := d.guildServer(ev.ID); srv != nil {
+			d.updateVoice(srv)
+		}
+		u.presenceChanged()
+	})
+	s.AddHandler(func(ev *gateway.GuildDeleteEvent) {
+		if srv := d.guildServer(ev.ID); srv != nil && !ev.Unavailable {
+			d.forgetGuild(srv)
+		}
+	})
+	s.AddHandler(func(ev *gateway.ChannelUpdateEvent) {
+		d.channelChanged(ev.Channel, u)
+	})
+	s.AddHandler(func(ev *gateway.VoiceStateUpdateEvent) {
+		srv := d.guildServer(ev.GuildID)
+		if srv == nil {
+			return
+		}
+		if ev.Member != nil {
+			d.getUser(ev.Member.User, srv)
+		}
+		d.setVoiceState(ev.GuildID, ev.VoiceState)
+		d.updateVoice(srv)
+		u.voiceChanged()
+	})
+	s.AddHandler(func(ev *gateway.UserGuildSettingsUpdateEvent) {
+		applyDiscordSettings(prefix, ev.UserGuildSettings)
+		u.channels.Refresh()
+	})
+	s.AddHandler(func(ev *gateway.PresenceUpdateEvent) {
+		d.setPresence(ev.Presence)
+		u.presenceChanged()
+	})
+	s.AddHandler(func(*gateway.ResumedEvent) {
+		d.online(u)
+	})
 	s.AddHandler(func(ev *gateway.MessageCreateEvent) {
-		ch := findChan(u.data, strconv.Itoa(int(ev.GuildID)), strconv.Itoa(int(ev.ChannelID)))
+		ch := findChan(d.servers, strconv.Itoa(int(ev.GuildID)), strconv.Itoa(int(ev.ChannelID)))
 		if ch == nil {
 			log.Println("Could not find channel for incoming message")
 			return
 		}
 
-		msg := &message{content: ev.Content, user: &user{
-			name:      ev.Author.Username,
-			avatarURL: ev.Author.AvatarURL()},
-		}
-		ch.messages = append(ch.messages, msg)
-		if ch == u.currentChannel {
-			u.appendMessages([]*message{msg})
-		}
+		u.messagesAdded(ch, ch.appendNew([]*message{d.newMessage(ev.Message, ch.server)}))
 	})
 
-	d.loadChannels(u)
+	return nil
 }
 
 func (d *discord) login(prefix string, u *ui) {
 	tok := d.app.Preferences().String(prefix + prefDiscordTokenKey)
-	if tok != "" {
-		sess, err := session.New(tok)
-		if err == nil {
-			d.loadServers(sess, u)
-			return
-		} else {
-			log.Println("Error connecting with token", err)
+	if tok == "" {
+		return
+	}
+
+	d.status = newConnection(u.connectionChanged)
+	var sess *session.Session
+	d.status.reconnect(func() error {
+		if sess == nil {
+			s, err := session.New(tok)
+			if err != nil {
+				log.Println("Error connecting with token", err)
+				return err
+			}
+			sess = s
 		}
+
+		return d.connect(sess, prefix, u)
+	})
+}
+
+// emojis lists the custom emoji uploaded to guild s.
+func (d *discord) emojis(s *server) ([]*customEmoji, error) {
+	if d.conn == nil {
+		return nil, errors.New("not connected")
+	} else if s == d.dms {
+		return nil, nil // custom emoji belong to guilds
+	}
+
+	id, _ := strconv.Atoi(s.id)
+	es, err := d.conn.Client.Emojis(discapi.GuildID(id))
+	if err != nil {
+		return nil, discordError(err)
 	}
+
+	var list []*customEmoji
+	for _, e := range es {
+		list = append(list, &customEmoji{id: e.ID.String(), name: e.Name, imageURL: e.EmojiURL() + "?size=32",
+			animated: e.Animated})
+	}
+	return list, nil
+}
+
+// getUser returns the user we know for a Discord user in server s, remembering them for mention completion.
+func (d *discord) getUser(u discapi.User, s *server) *user {
+	id := u.ID.String()
+	userLock.RLock()
+	usr, found := s.users[id]
+	userLock.RUnlock()
+	if found {
+		return usr
+	}
+
+	usr = &user{id: id, name: u.Username, username: u.Username, avatarURL: u.AvatarURL()}
+	userLock.Lock()
+	usr.presence = d.presence[u.ID]
+	s.users[id] = usr
+	userLock.Unlock()
+	return usr
+}
+
+// setPresence records a presence from the gateway, updating the user in every server we have seen them in.
+func (d *discord) setPresence(p discapi.Presence) {
+	state := presenceOffline
+	switch p.Status {
+	case discapi.OnlineStatus:
+		state = presenceOnline
+	case discapi.IdleStatus:
+		state = presenceAway
+	case discapi.DoNotDisturbStatus:
+		state = presenceBusy
+	}
+
+	userLock.Lock()
+	defer userLock.Unlock()
+	d.presence[p.User.ID] = state
+	for _, s := range d.servers {
+		if usr, ok := s.users[p.User.ID.String()]; ok {
+			usr.presence = state
+		}
+	}
+}
+
+// directChannel opens the direct message channel with usr, Discord returns the existing one if we have talked before.
+func (d *discord) directChannel(usr *user) (*channel, error) {
+	if d.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
+	id, _ := strconv.Atoi(usr.id)
+	c, err := d.conn.Client.CreatePrivateChannel(discapi.UserID(id))
+	if err != nil {
+		return nil, discordError(err)
+	}
+	dms := d.directServer()
+	if ch := findServerChan(dms, c.ID.String()); ch != nil {
+		return ch, nil
+	}
+
+	ch := &channel{id: c.ID.String(), name: "@" + usr.displayName(), direct: true, server: dms}
+	migrateChannelKey(ch)
+	dms.channels = append(dms.channels, ch)
+	ch.appendNew(d.loadRecentMessages(dms, c.ID))
+	return ch, nil
+}
+
+// directServer returns the server that holds our direct messages, creating it the first time.
+// It has the id that the gateway uses for messages outside of a guild.
+func (d *discord) directServer() *server {
+	if d.dms != nil {
+		return d.dms
+	}
+
+	d.dms = &server{service: d, name: "Direct Messages", id: "0", iconResource: theme.AccountIcon(),
+		users: make(map[string]*user)}
+	if len(d.servers) > 0 {
+		d.dms.account, d.dms.login, d.dms.status = d.servers[0].account, d.servers[0].login, d.status
+	}
+	d.servers = append(d.servers, d.dms)
+	return d.dms
+}
+
+// members lists the people in the guild of ch with their roles, using their nickname for that guild if they have one.
+func (d *discord) members(ch *channel) ([]*member, error) {
+	if d.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
+	if ch.direct {
+		return d.directMembers(ch)
+	}
+
+	id, _ := strconv.Atoi(ch.server.id)
+	ms, err := d.conn.Client.Members(discapi.GuildID(id), discordMemberLimit)
+	if err != nil {
+		return nil, discordError(err)
+	}
+
+	roles := make(map[discapi.RoleID]string)
+	if rs, err := d.conn.Client.Roles(discapi.GuildID(id)); err == nil {
+		for _, r := range rs {
+			if r.ID != discapi.RoleID(id) { // the @everyone role has the id of the guild
+				roles[r.ID] = r.Name
+			}
+		}
+	}
+
+	var list []*member
+	for _, m := range ms {
+		usr := d.getUser(m.User, ch.server)
+		if m.Nick != "" {
+			usr.name = m.Nick
+		}
+		mem := &member{user: usr}
+		for _, r := range m.RoleIDs {
+			if name, ok := roles[r]; ok {
+				mem.roles = append(mem.roles, name)
+			}
+		}
+		list = append(list, mem)
+	}
+	return list, nil
+}
+
+// guildServer returns the server we made for the guild with id, or nil if we do not have it.
+func (d *discord) guildServer(id discapi.GuildID) *server {
+	for _, s := range d.servers {
+		if s.id == id.String() {
+			return s
+		}
+	}
+	return nil
+}
+
+// setVoiceState records the voice channel of a guild that a user is connected to, if any.
+func (d *discord) setVoiceState(guild discapi.GuildID, v discapi.VoiceState) {
+	userLock.Lock()
+	defer userLock.Unlock()
+	states, ok := d.voice[guild]
+	if !ok {
+		states = make(map[discapi.UserID]discapi.ChannelID)
+		d.voice[guild] = states
+	}
+	if v.ChannelID.IsValid() {
+		states[v.UserID] = v.ChannelID
+	} else {
+		delete(states, v.UserID)
+	}
+}
+
+// updateVoice sets who is talking in each voice channel of s, looking up anyone we have not seen before.
+func (d *discord) updateVoice(s *server) {
+	id, _ := strconv.Atoi(s.id)
+	talking := make(map[string][]discapi.UserID)
+	userLock.RLock()
+	for u, ch := range d.voice[discapi.GuildID(id)] {
+		talking[ch.String()] = append(talking[ch.String()], u)
+	}
+	userLock.RUnlock()
+
+	for _, ch := range s.channels {
+		if !ch.voice {
+			continue
+		}
+
+		var list []*user
+		for _, u := range talking[ch.id] {
+			list = append(list, d.voiceUser(u, s))
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return strings.ToLower(list[i].displayName()) < strings.ToLower(list[j].displayName())
+		})
+		ch.talking = list
+	}
+}
+
+// voiceUser returns the user with id in s, asking Discord about them if we have not seen them yet.
+func (d *discord) voiceUser(id discapi.UserID, s *server) *user {
+	userLock.RLock()
+	usr, ok := s.users[id.String()]
+	userLock.RUnlock()
+	if ok {
+		return usr
+	}
+
+	if d.conn != nil {
+		if u, err := d.conn.Client.User(id); err == nil {
+			return d.getUser(*u, s)
+		}
+	}
+	return &user{id: id.String(), name: id.String()}
+}
+
+// directMembers lists the people in a direct message channel, including us.
+func (d *discord) directMembers(ch *channel) ([]*member, error) {
+	id, _ := strconv.Atoi(ch.id)
+	c, err := d.conn.Client.Channel(discapi.ChannelID(id))
+	if err != nil {
+		return nil, discordError(err)
+	}
+	me, err := d.conn.Me()
+	if err != nil {
+		return nil, discordError(err)
+	}
+
+	list := []*member{{user: d.getUser(*me, ch.server)}}
+	for _, u := range c.DMRecipients {
+		list = append(list, &member{user: d.getUser(u, ch.server)})
+	}
+	return list, nil
+}
+
+// online is called when the gateway is ready, if we had lost connection it catches up on missed messages.
+func (d *discord) online(u *ui) {
+	if d.status.currentState() != stateReconnecting {
+		return
+	}
+
+	d.status.setState(stateOnline)
+	d.resync(u)
+}
+
+// resync loads the recent messages for each channel, adding any that arrived while we were offline.
+func (d *discord) resync(u *ui) {
+	for _, s := range d.servers {
+		for _, c := range s.channels {
+			if c.voice {
+				continue
+			}
+
+			id, _ := strconv.Atoi(c.id)
+			u.messagesAdded(c, c.appendNew(d.loadRecentMessages(s, discapi.ChannelID(id))))
+		}
+	}
+}
+
+// search asks each guild to search its messages, the API returns the matching message with some context around it.
+func (d *discord) search(q searchQuery) ([]*searchResult, error) {
+	if d.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
+	var results []*searchResult
+	for _, s := range d.servers {
+		if s == d.dms {
+			continue // direct messages are not searchable by guild
+		}
+		params := url.Values{}
+		if q.text != "" {
+			params.Set("content", q.text)
+		}
+		if !q.from.IsZero() {
+			params.Set("min_id", discapi.NewSnowflake(q.from).String())
+		}
+		if !q.to.IsZero() {
+			params.Set("max_id", discapi.NewSnowflake(q.to).String())
+		}
+		if q.channel != "" {
+			found := false
+			for _, c := range s.channels {
+				if containsFold(c.name, q.channel) {
+					params.Add("channel_id", c.id)
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if len(params) == 0 {
+			return nil, nil // the server will not list every message
+		}
+
+		var resp struct {
+			Messages [][]struct {
+				discapi.Message
+				Hit bool `json:"hit"`
+			} `json:"messages"`
+		}
+		err := d.conn.RequestJSON(&resp, "GET", api.EndpointGuilds+s.id+"/messages/search?"+params.Encode())
+		if err != nil {
+			fyne.LogError("Failed to search "+s.name, discordError(err))
+			continue
+		}
+
+		for _, group := range resp.Messages {
+			for _, m := range group {
+				if !m.Hit {
+					continue
+				}
+
+				chID := strconv.Itoa(int(m.ChannelID))
+				name := chID
+				if ch := findServerChan(s, chID); ch != nil {
+					name = ch.name
+				}
+				r := &searchResult{login: s.login, server: s.id, channel: chID, msgID: m.ID.String(),
+					channelName: name, author: m.Author.Username, snippet: m.Content, content: m.Content,
+					sent: m.Timestamp.Time(), remote: true}
+				if q.matches(r) {
+					results = append(results, r)
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+func (d *discord) send(ch *channel, rich []richSpan) error {
+	if d.conn == nil {
+		return errors.New("not connected")
+	}
+
+	text := formatMarkup(rich, discordMarkup, markupTokens{
+		link: func(text, url string) string {
+			if text == url {
+				return url
+			}
+			return "[" + text + "](" + url + ")"
+		},
+		mention: func(id string) string {
+			return "<@" + id + ">"
+		},
+		emoji: func(name, id string) string {
+			for _, e := range ch.server.emojis {
+				if e.id == id && e.animated {
+					return "<a:" + name + ":" + id + ">"
+				}
+			}
+			return "<:" + name + ":" + id + ">"
+		},
+		escape: func(text string) string {
+			return escapeMarkup(text, discordMarkup)
+		}})
+	id, _ := strconv.Atoi(ch.id)
+	_, err := d.conn.SendText(discapi.ChannelID(id), text)
+	return err
 }
 
-func (d *discord) send(ch *channel, text string) {
+// pinned loads the messages pinned in ch.
+func (d *discord) pinned(ch *channel) ([]*message, error) {
+	if d.conn == nil {
+		return nil, errors.New("not connected")
+	}
+
 	id, _ := strconv.Atoi(ch.id)
-	d.conn.SendText(discapi.ChannelID(id), text)
+	ms, err := d.conn.Client.PinnedMessages(discapi.ChannelID(id))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*message, len(ms))
+	for i, m := range ms {
+		list[i] = d.newMessage(m, ch.server)
+	}
+	return list, nil
+}
+
+// setPinned pins or unpins m in its channel.
+func (d *discord) setPinned(m *message, on bool) error {
+	if d.conn == nil {
+		return errors.New("not connected")
+	}
+
+	chID, _ := strconv.Atoi(m.channel.id)
+	id, _ := strconv.Atoi(m.id)
+	if on {
+		return d.conn.Client.PinMessage(discapi.ChannelID(chID), discapi.MessageID(id))
+	}
+	return d.conn.Client.UnpinMessage(discapi.ChannelID(chID), discapi.MessageID(id))
+}
+
+// setChannelFlag mutes or unmutes a guild channel in the settings of our account, other settings are only local.
+func (d *discord) setChannelFlag(ch *channel, f channelFlag, on bool) error {
+	if f != flagMuted || ch.server == d.dms {
+		return nil
+	}
+	if d.conn == nil {
+		return errors.New("not connected")
+	}
+
+	settings := map[string]interface{}{"channel_overrides": map[string]interface{}{ch.id: map[string]bool{"muted": on}}}
+	return discordError(d.conn.Client.FastRequest("PATCH", api.EndpointMe+"/guilds/"+ch.server.id+"/settings",
+		httputil.WithJSONBody(settings)))
+}
+
+// applyDiscordSettings mutes the channels of login that are muted in the guild settings of the account.
+func applyDiscordSettings(login string, g gateway.UserGuildSettings) {
+	for _, o := range g.ChannelOverrides {
+		setKeyFlag(login, channelKey(g.GuildID.String(), o.ChannelID.String(), false), flagMuted, o.Muted)
+	}
 }
 
 func (d *discord) doLogin(email, pass string, p fyne.Preferences, prefix string, u *ui) {
+	d.status = newConnection(u.connectionChanged)
 	sess, err := session.Login(email, pass, "")
 	if err == nil {
 		p.SetString(prefix+prefDiscordTokenKey, sess.Token)
-		d.loadServers(sess, u)
+		d.status.reconnect(func() error {
+			return d.connect(sess, prefix, u)
+		})
 		return
 	}
 
@@ -189,6 +993,47 @@ func (d *discord) doLogin(email, pass string, p fyne.Preferences, prefix string,
 			}
 
 			p.SetString(prefix+prefDiscordTokenKey, sess.Token)
-			d.loadServers(sess, u)
+			d.status.reconnect(func() error {
+				return d.connect(sess, prefix, u)
+			})
 		}, u.win)
 }
+
+// discordRich converts Discord markdown and the mention, channel and emoji tokens in a message into rich text.
+func discordRich(m discapi.Message, s *server) []richSpan {
+	spans := linkURLs(parseMarkup(m.Content, discordMarkup, 0))
+	return expandTokens(spans, discordToken, func(match []string) richSpan {
+		id := match[4]
+		switch match[1] {
+		case "#":
+			if ch := findServerChan(s, id); ch != nil {
+				return richSpan{text: ch.name, channel: ch}
+			}
+			return richSpan{text: "#unknown-channel"}
+		case "@&":
+			return richSpan{text: "@role", mention: true} // role names are not part of the message
+		case "@", "@!":
+			for _, usr := range m.Mentions {
+				if usr.ID.String() == id {
+					return richSpan{text: "@" + usr.Username, mention: true}
+				}
+			}
+			return richSpan{text: "@unknown-user", mention: true}
+		}
+
+		ext := ".png"
+		if match[2] == "a" {
+			ext = ".gif"
+		}
+		return richSpan{text: ":" + match[3] + ":", emoji: "https://cdn.discordapp.com/emojis/" + id + ext + "?size=32"}
+	})
+}
+
+// discordError marks errors caused by an expired or revoked token so that we stop trying to reconnect.
+func discordError(err error) error {
+	var httpErr *httputil.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Status == http.StatusUnauthorized {
+		return fmt.Errorf("%w: %v", errAuthRequired, err)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"fyne.io/fyne/v2"
+)
+
+const draftsFile = "fybro-drafts.json"
+
+// drafts holds the unsent text of each channel, it is stored so that it survives a restart.
+type drafts struct {
+	text map[string]string
+	path string
+}
+
+func newDrafts(a fyne.App) *drafts {
+	d := &drafts{path: filepath.Join(a.Storage().RootURI().Path(), draftsFile), text: make(map[string]string)}
+	d.load()
+	return d
+}
+
+// get returns the draft saved for ch, or "" if there is none.
+func (d *drafts) get(ch *channel) string {
+	return d.text[draftKey(ch)]
+}
+
+// set remembers text as the draft for ch and saves it if it changed.
+func (d *drafts) set(ch *channel, text string) {
+	key := draftKey(ch)
+	if d.text[key] == text {
+		return
+	}
+
+	if text == "" {
+		delete(d.text, key)
+	} else {
+		d.text[key] = text
+	}
+	d.save()
+}
+
+func (d *drafts) load() {
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fyne.LogError("Failed to read drafts", err)
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, &d.text)
+	if err != nil {
+		fyne.LogError("Failed to parse drafts", err)
+	}
+}
+
+func (d *drafts) save() {
+	data, err := json.Marshal(d.text)
+	if err != nil {
+		fyne.LogError("Failed to encode drafts", err)
+		return
+	}
+
+	err = os.WriteFile(d.path, data, 0600)
+	if err != nil {
+		fyne.LogError("Failed to save drafts", err)
+	}
+}
+
+// draftKey identifies a channel across restarts, channel keys are only unique within a login.
+func draftKey(ch *channel) string {
+	return ch.server.login + "/" + ch.key()
+}
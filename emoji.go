@@ -0,0 +1,152 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"fyne.io/fyne/v2"
+)
+
+const (
+	prefEmojiRecentKey = "emoji.recent"
+
+	maxRecentEmoji = 24
+)
+
+// emojiCode is an emoji and the shortcode, without colons, that people type for it.
+type emojiCode struct {
+	code, emoji string
+}
+
+var emojiCodePattern = regexp.MustCompile(`:\w+:`)
+
+// standardEmoji lists common emoji in the order the picker shows them.
+var standardEmoji = []emojiCode{
+	{"grinning", "😀"}, {"smiley", "😃"}, {"smile", "😄"}, {"grin", "😁"}, {"laughing", "😆"},
+	{"sweat_smile", "😅"}, {"rofl", "🤣"}, {"joy", "😂"}, {"slightly_smiling_face", "🙂"},
+	{"upside_down_face", "🙃"}, {"wink", "😉"}, {"blush", "😊"}, {"innocent", "😇"},
+	{"smiling_face_with_three_hearts", "🥰"}, {"heart_eyes", "😍"}, {"star_struck", "🤩"},
+	{"kissing_heart", "😘"}, {"yum", "😋"}, {"stuck_out_tongue", "😛"}, {"stuck_out_tongue_winking_eye", "😜"},
+	{"zany_face", "🤪"}, {"money_mouth_face", "🤑"}, {"hugs", "🤗"}, {"hand_over_mouth", "🤭"},
+	{"shushing_face", "🤫"}, {"thinking", "🤔"}, {"zipper_mouth_face", "🤐"}, {"raised_eyebrow", "🤨"},
+	{"neutral_face", "😐"}, {"expressionless", "😑"}, {"no_mouth", "😶"}, {"smirk", "😏"},
+	{"unamused", "😒"}, {"roll_eyes", "🙄"}, {"grimacing", "😬"}, {"lying_face", "🤥"},
+	{"relieved", "😌"}, {"pensive", "😔"}, {"sleepy", "😪"}, {"drooling_face", "🤤"}, {"sleeping", "😴"},
+	{"mask", "😷"}, {"face_with_thermometer", "🤒"}, {"nauseated_face", "🤢"}, {"vomiting_face", "🤮"},
+	{"sneezing_face", "🤧"}, {"hot_face", "🥵"}, {"cold_face", "🥶"}, {"woozy_face", "🥴"},
+	{"dizzy_face", "😵"}, {"exploding_head", "🤯"}, {"cowboy_hat_face", "🤠"}, {"partying_face", "🥳"},
+	{"sunglasses", "😎"}, {"nerd_face", "🤓"}, {"monocle_face", "🧐"}, {"confused", "😕"},
+	{"worried", "😟"}, {"slightly_frowning_face", "🙁"}, {"open_mouth", "😮"}, {"hushed", "😯"},
+	{"astonished", "😲"}, {"flushed", "😳"}, {"pleading_face", "🥺"}, {"frowning", "😦"},
+	{"anguished", "😧"}, {"fearful", "😨"}, {"cold_sweat", "😰"}, {"disappointed_relieved", "😥"},
+	{"cry", "😢"}, {"sob", "😭"}, {"scream", "😱"}, {"confounded", "😖"}, {"persevere", "😣"},
+	{"disappointed", "😞"}, {"sweat", "😓"}, {"weary", "😩"}, {"tired_face", "😫"}, {"yawning_face", "🥱"},
+	{"triumph", "😤"}, {"rage", "😡"}, {"angry", "😠"}, {"cursing_face", "🤬"}, {"smiling_imp", "😈"},
+	{"skull", "💀"}, {"poop", "💩"}, {"clown_face", "🤡"}, {"ghost", "👻"}, {"alien", "👽"}, {"robot", "🤖"},
+	{"see_no_evil", "🙈"}, {"hear_no_evil", "🙉"}, {"speak_no_evil", "🙊"},
+
+	{"wave", "👋"}, {"raised_hand", "✋"}, {"ok_hand", "👌"}, {"pinched_fingers", "🤌"}, {"v", "✌️"},
+	{"crossed_fingers", "🤞"}, {"love_you_gesture", "🤟"}, {"metal", "🤘"}, {"call_me_hand", "🤙"},
+	{"point_left", "👈"}, {"point_right", "👉"}, {"point_up", "☝️"}, {"point_down", "👇"},
+	{"middle_finger", "🖕"}, {"thumbsup", "👍"}, {"thumbsdown", "👎"}, {"fist", "✊"}, {"punch", "👊"},
+	{"clap", "👏"}, {"raised_hands", "🙌"}, {"open_hands", "👐"}, {"handshake", "🤝"}, {"pray", "🙏"},
+	{"writing_hand", "✍️"}, {"muscle", "💪"}, {"eyes", "👀"}, {"brain", "🧠"}, {"facepalm", "🤦"},
+	{"shrug", "🤷"}, {"man_dancing", "🕺"}, {"dancer", "💃"},
+
+	{"heart", "❤️"}, {"orange_heart", "🧡"}, {"yellow_heart", "💛"}, {"green_heart", "💚"},
+	{"blue_heart", "💙"}, {"purple_heart", "💜"}, {"black_heart", "🖤"}, {"white_heart", "🤍"},
+	{"broken_heart", "💔"}, {"two_hearts", "💕"}, {"sparkling_heart", "💖"}, {"heartpulse", "💗"},
+	{"kiss", "💋"}, {"100", "💯"}, {"anger", "💢"}, {"boom", "💥"}, {"dizzy", "💫"}, {"sweat_drops", "💦"},
+	{"zzz", "💤"}, {"speech_balloon", "💬"}, {"thought_balloon", "💭"},
+
+	{"dog", "🐶"}, {"cat", "🐱"}, {"mouse", "🐭"}, {"rabbit", "🐰"}, {"fox_face", "🦊"}, {"bear", "🐻"},
+	{"panda_face", "🐼"}, {"koala", "🐨"}, {"tiger", "🐯"}, {"lion", "🦁"}, {"cow", "🐮"}, {"pig", "🐷"},
+	{"frog", "🐸"}, {"monkey_face", "🐵"}, {"chicken", "🐔"}, {"penguin", "🐧"}, {"unicorn", "🦄"},
+	{"bee", "🐝"}, {"bug", "🐛"}, {"butterfly", "🦋"}, {"snail", "🐌"}, {"turtle", "🐢"}, {"snake", "🐍"},
+	{"octopus", "🐙"}, {"crab", "🦀"}, {"fish", "🐟"}, {"whale", "🐳"}, {"dolphin", "🐬"},
+	{"sunflower", "🌻"}, {"rose", "🌹"}, {"cherry_blossom", "🌸"}, {"tulip", "🌷"}, {"seedling", "🌱"},
+	{"evergreen_tree", "🌲"}, {"cactus", "🌵"}, {"four_leaf_clover", "🍀"}, {"fallen_leaf", "🍂"},
+	{"sun_with_face", "🌞"}, {"full_moon", "🌕"}, {"crescent_moon", "🌙"}, {"star", "⭐"},
+	{"star2", "🌟"}, {"sparkles", "✨"}, {"zap", "⚡"}, {"fire", "🔥"}, {"rainbow", "🌈"},
+	{"sunny", "☀️"}, {"cloud", "☁️"}, {"umbrella", "☔"}, {"snowflake", "❄️"}, {"snowman", "⛄"},
+	{"ocean", "🌊"},
+
+	{"apple", "🍎"}, {"banana", "🍌"}, {"watermelon", "🍉"}, {"grapes", "🍇"}, {"strawberry", "🍓"},
+	{"peach", "🍑"}, {"cherries", "🍒"}, {"avocado", "🥑"}, {"eggplant", "🍆"}, {"hot_pepper", "🌶️"},
+	{"bread", "🍞"}, {"cheese", "🧀"}, {"egg", "🥚"}, {"bacon", "🥓"}, {"hamburger", "🍔"}, {"fries", "🍟"},
+	{"pizza", "🍕"}, {"hotdog", "🌭"}, {"taco", "🌮"}, {"burrito", "🌯"}, {"spaghetti", "🍝"},
+	{"ramen", "🍜"}, {"sushi", "🍣"}, {"popcorn", "🍿"}, {"doughnut", "🍩"}, {"cookie", "🍪"},
+	{"birthday", "🎂"}, {"cake", "🍰"}, {"chocolate_bar", "🍫"}, {"candy", "🍬"}, {"coffee", "☕"},
+	{"tea", "🍵"}, {"beer", "🍺"}, {"beers", "🍻"}, {"wine_glass", "🍷"}, {"cocktail", "🍸"},
+	{"champagne", "🍾"},
+
+	{"soccer", "⚽"}, {"basketball", "🏀"}, {"football", "🏈"}, {"tennis", "🎾"}, {"trophy", "🏆"},
+	{"medal_sports", "🏅"}, {"video_game", "🎮"}, {"game_die", "🎲"}, {"dart", "🎯"}, {"guitar", "🎸"},
+	{"musical_note", "🎵"}, {"notes", "🎶"}, {"microphone", "🎤"}, {"headphones", "🎧"}, {"art", "🎨"},
+	{"tada", "🎉"}, {"confetti_ball", "🎊"}, {"balloon", "🎈"}, {"gift", "🎁"}, {"christmas_tree", "🎄"},
+	{"jack_o_lantern", "🎃"},
+
+	{"car", "🚗"}, {"taxi", "🚕"}, {"bus", "🚌"}, {"train", "🚆"}, {"bike", "🚲"}, {"airplane", "✈️"},
+	{"rocket", "🚀"}, {"ship", "🚢"}, {"house", "🏠"}, {"office", "🏢"}, {"earth_africa", "🌍"},
+	{"earth_americas", "🌎"}, {"earth_asia", "🌏"}, {"world_map", "🗺️"}, {"mountain", "⛰️"},
+	{"beach_umbrella", "🏖️"}, {"tent", "⛺"},
+
+	{"watch", "⌚"}, {"iphone", "📱"}, {"computer", "💻"}, {"keyboard", "⌨️"}, {"desktop_computer", "🖥️"},
+	{"camera", "📷"}, {"tv", "📺"}, {"telephone_receiver", "📞"}, {"battery", "🔋"}, {"bulb", "💡"},
+	{"moneybag", "💰"}, {"dollar", "💵"}, {"credit_card", "💳"}, {"gem", "💎"}, {"wrench", "🔧"},
+	{"hammer", "🔨"}, {"gear", "⚙️"}, {"lock", "🔒"}, {"unlock", "🔓"}, {"key", "🔑"}, {"bell", "🔔"},
+	{"no_bell", "🔕"}, {"mag", "🔍"}, {"link", "🔗"}, {"paperclip", "📎"}, {"pushpin", "📌"},
+	{"memo", "📝"}, {"pencil2", "✏️"}, {"book", "📖"}, {"books", "📚"}, {"calendar", "📅"},
+	{"chart_with_upwards_trend", "📈"}, {"chart_with_downwards_trend", "📉"}, {"clipboard", "📋"},
+	{"email", "📧"}, {"package", "📦"}, {"hourglass", "⌛"}, {"alarm_clock", "⏰"}, {"bomb", "💣"},
+	{"pill", "💊"},
+
+	{"white_check_mark", "✅"}, {"heavy_check_mark", "✔️"}, {"x", "❌"}, {"negative_squared_cross_mark", "❎"},
+	{"warning", "⚠️"}, {"no_entry", "⛔"}, {"no_entry_sign", "🚫"}, {"question", "❓"}, {"exclamation", "❗"},
+	{"bangbang", "‼️"}, {"interrobang", "⁉️"}, {"heavy_plus_sign", "➕"}, {"heavy_minus_sign", "➖"},
+	{"arrow_up", "⬆️"}, {"arrow_down", "⬇️"}, {"arrow_left", "⬅️"}, {"arrow_right", "➡️"},
+	{"arrows_counterclockwise", "🔄"}, {"recycle", "♻️"}, {"red_circle", "🔴"}, {"green_circle", "🟢"},
+	{"large_blue_circle", "🔵"}, {"checkered_flag", "🏁"}, {"triangular_flag_on_post", "🚩"},
+	{"rainbow_flag", "🏳️‍🌈"}, {"ok", "🆗"}, {"new", "🆕"}, {"cool", "🆒"}, {"free", "🆓"}, {"sos", "🆘"},
+}
+
+// emojiShortcode returns the emoji for a shortcode, without its colons, or "" if we do not know it.
+func emojiShortcode(code string) string {
+	for _, e := range standardEmoji {
+		if e.code == code {
+			return e.emoji
+		}
+	}
+	return ""
+}
+
+// recentEmoji returns the emoji the user picked most recently, newest first.
+// Custom emoji are stored as the token that the composer sends for them.
+func recentEmoji() []string {
+	return fyne.CurrentApp().Preferences().StringList(prefEmojiRecentKey)
+}
+
+// addRecentEmoji moves emoji to the front of the recently used list.
+func addRecentEmoji(emoji string) {
+	list := []string{emoji}
+	for _, e := range recentEmoji() {
+		if e != emoji && len(list) < maxRecentEmoji {
+			list = append(list, e)
+		}
+	}
+	fyne.CurrentApp().Preferences().SetStringList(prefEmojiRecentKey, list)
+}
+
+// matchEmoji returns the standard emoji whose shortcode starts with the query, then those that contain it.
+func matchEmoji(query string) []emojiCode {
+	query = strings.ToLower(query)
+	var starts, contains []emojiCode
+	for _, e := range standardEmoji {
+		if strings.HasPrefix(e.code, query) {
+			starts = append(starts, e)
+		} else if strings.Contains(e.code, query) {
+			contains = append(contains, e)
+		}
+	}
+	return append(starts, contains...)
+}
@@ -9,6 +9,7 @@ require (
 	github.com/Rhymen/go-whatsapp v0.1.1
 	github.com/celestix/gotgproto v1.0.0-beta18
 	github.com/diamondburned/arikawa v1.3.14
+	github.com/glebarez/go-sqlite v1.21.2
 	github.com/glebarez/sqlite v1.10.0
 	github.com/gotd/td v0.102.0
 	github.com/skip2/go-qrcode v0.0.0-20190110000554-dc11ecdae0a9
@@ -26,7 +27,6 @@ require (
 	github.com/fyne-io/gl-js v0.0.0-20220119005834-d2da28d9ccfe // indirect
 	github.com/fyne-io/glfw-js v0.0.0-20240101223322-6e1efdc71b7a // indirect
 	github.com/fyne-io/image v0.0.0-20220602074514-4956b0afb3d2 // indirect
-	github.com/glebarez/go-sqlite v1.21.2 // indirect
 	github.com/go-faster/errors v0.7.1 // indirect
 	github.com/go-faster/jx v1.1.0 // indirect
 	github.com/go-faster/xor v1.0.0 // indirect
@@ -16,6 +16,7 @@ const (
 	prefServerCountKey = "server.count"
 	prefServerPrefix   = "server.%d."
 	prefServerTypeKey  = "type"
+	prefServerNameKey  = "name"
 
 	winTitle = "Fybro"
 )
@@ -32,6 +33,10 @@ func main() {
 	w.ShowAndRun()
 
 	// after app quits
+	u.saveDraft()
+	if u.data != nil {
+		u.search.update(u.data.servers) // keep what we saw this time for searching later
+	}
 	disconnectAll()
 }
 
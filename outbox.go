@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+)
+
+const outboxFile = "fybro-outbox.json"
+
+// outboxUser is shown as the author of messages that have not been sent yet.
+var outboxUser = &user{name: "You"}
+
+// outgoing is a message waiting to be sent, it is stored so that we can try again after a restart.
+type outgoing struct {
+	Login   string    `json:"login"`
+	Server  string    `json:"server"`
+	Channel string    `json:"channel"`
+	Direct  bool      `json:"direct"`
+	Text    string    `json:"text"`
+	Queued  time.Time `json:"queued"`
+	Failed  bool      `json:"failed"`
+
+	box     *outbox
+	msg     *message
+	sending bool
+}
+
+// failed returns true if the message could not be sent and is waiting for the user to retry or discard it.
+func (o *outgoing) failed() bool {
+	o.box.lock.Lock()
+	defer o.box.lock.Unlock()
+	return o.Failed
+}
+
+func (o *outgoing) forChannel(ch *channel) bool {
+	return ch != nil && ch.server.login == o.Login && ch.key() == channelKey(o.Server, o.Channel, o.Direct)
+}
+
+// retry clears a failed state and tries to send again.
+func (o *outgoing) retry() {
+	o.box.lock.Lock()
+	o.Failed = false
+	o.box.save()
+	o.box.lock.Unlock()
+
+	o.box.u.refreshOutgoing(o)
+	go o.box.deliver(o)
+}
+
+// discard removes the message from the outbox without sending it.
+func (o *outgoing) discard() {
+	o.box.lock.Lock()
+	o.box.remove(o)
+	o.box.lock.Unlock()
+
+	o.box.u.refreshOutgoing(o)
+}
+
+type outbox struct {
+	lock  sync.Mutex
+	items []*outgoing
+	path  string
+
+	u *ui
+}
+
+func newOutbox(u *ui, a fyne.App) *outbox {
+	box := &outbox{path: filepath.Join(a.Storage().RootURI().Path(), outboxFile), u: u}
+	box.load()
+	return box
+}
+
+// add queues text to be sent to ch and starts trying to deliver it.
+func (b *outbox) add(ch *channel, text string) {
+	item := &outgoing{Login: ch.server.login, Server: ch.server.id, Channel: ch.id, Direct: ch.direct, Text: text,
+		Queued: time.Now(), box: b}
+	item.msg = &message{content: text, rich: parseComposed(text), sent: item.Queued, user: outboxUser, outgoing: item}
+
+	b.lock.Lock()
+	b.items = append(b.items, item)
+	b.save()
+	b.lock.Unlock()
+
+	b.u.refreshOutgoing(item)
+	go b.deliver(item)
+}
+
+// deliver sends the item if its login is online, removing it from the outbox if that succeeds.
+// If the send fails while offline it stays queued for the next flush, otherwise it is marked as failed.
+func (b *outbox) deliver(item *outgoing) {
+	srv := b.findServer(item)
+	if srv == nil || (srv.status != nil && srv.status.currentState() != stateOnline) {
+		return
+	}
+
+	b.lock.Lock()
+	if item.sending || item.Failed {
+		b.lock.Unlock()
+		return
+	}
+	item.sending = true
+	b.lock.Unlock()
+
+	// matching the key, as a direct message can share its id with a group
+	ch := findKey(srv, channelKey(srv.id, item.Channel, item.Direct))
+	if ch == nil { // channels may still be loading, we know enough to send
+		ch = &channel{id: item.Channel, direct: item.Direct, server: srv}
+	}
+	err := srv.service.send(ch, parseComposed(item.Text))
+
+	b.lock.Lock()
+	item.sending = false
+	if err == nil {
+		b.remove(item)
+	} else {
+		fyne.LogError("Failed to send message", err)
+		if srv.status == nil || srv.status.currentState() == stateOnline {
+			item.Failed = true
+			b.save()
+		}
+	}
+	b.lock.Unlock()
+
+	b.u.refreshOutgoing(item)
+}
+
+func (b *outbox) findServer(item *outgoing) *server {
+	if b.u.data == nil {
+		return nil
+	}
+
+	for _, s := range b.u.data.servers {
+		if s.login == item.Login && s.id == item.Server {
+			return s
+		}
+	}
+	return nil
+}
+
+// flush tries to deliver all queued messages, it is called when a connection comes online.
+func (b *outbox) flush() {
+	b.lock.Lock()
+	items := append([]*outgoing{}, b.items...)
+	b.lock.Unlock()
+
+	for _, item := range items {
+		go b.deliver(item)
+	}
+}
+
+// pending returns the messages waiting to be sent to ch.
+func (b *outbox) pending(ch *channel) []*message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var list []*message
+	for _, item := range b.items {
+		if item.forChannel(ch) {
+			list = append(list, item.msg)
+		}
+	}
+	return list
+}
+
+// all returns every message waiting to be sent, for showing in the inbox.
+func (b *outbox) all() []*message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var list []*message
+	for _, item := range b.items {
+		list = append(list, item.msg)
+	}
+	return list
+}
+
+func (b *outbox) load() {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fyne.LogError("Failed to read outbox", err)
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, &b.items)
+	if err != nil {
+		fyne.LogError("Failed to parse outbox", err)
+		return
+	}
+	for _, item := range b.items {
+		item.box = b
+		item.msg = &message{content: item.Text, rich: parseComposed(item.Text), sent: item.Queued, user: outboxUser,
+			outgoing: item}
+	}
+}
+
+// remove takes item out of the outbox and saves the change, the lock must be held.
+func (b *outbox) remove(item *outgoing) {
+	for i, o := range b.items {
+		if o == item {
+			b.items = append(b.items[:i], b.items[i+1:]...)
+			break
+		}
+	}
+	b.save()
+}
+
+// save writes the outbox to disk, the lock must be held.
+func (b *outbox) save() {
+	data, err := json.Marshal(b.items)
+	if err != nil {
+		fyne.LogError("Failed to encode outbox", err)
+		return
+	}
+
+	err = os.WriteFile(b.path, data, 0600)
+	if err != nil {
+		fyne.LogError("Failed to save outbox", err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/storage"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// richStyle is a set of formatting flags that a piece of message text can have.
+type richStyle int
+
+const (
+	richBold richStyle = 1 << iota
+	richItalic
+	richUnderline
+	richStrike
+	richCode
+	richCodeBlock
+	richSpoiler
+)
+
+// richSpan is a piece of message content in the format that every service converts its markup into.
+type richSpan struct {
+	text    string
+	style   richStyle
+	link    string   // a URL to open when tapped
+	mention bool     // a user mention, drawn highlighted
+	userID  string   // the service id of the mentioned user, if known
+	channel *channel // a channel link, which opens the channel when tapped
+	emoji   string   // the image URL of a custom emoji, text holds its name
+	emojiID string   // the service id of a custom emoji we are sending
+	file    string   // the URI of an attached photo or document, opened when tapped
+}
+
+// token returns true if the span is a link, mention or emoji rather than text.
+func (s richSpan) token() bool {
+	return s.link != "" || s.mention || s.channel != nil || s.emoji != "" || s.emojiID != "" || s.file != ""
+}
+
+// markupDelim is a pair of markers, like the * in *bold*, that apply a style to the text between them.
+type markupDelim struct {
+	mark  string
+	style richStyle
+	word  bool // the markers must be at the edges of words, so that snake_case is not italic
+}
+
+// markupTokens formats the parts of rich text that a service writes as special tokens rather than styled text.
+// Any that are nil are written as their plain text.
+type markupTokens struct {
+	link    func(text, url string) string
+	mention func(id string) string
+	emoji   func(name, id string) string
+	escape  func(text string) string // makes plain text literal, so that the service does not read it as markup
+}
+
+var (
+	// composerMarkup is the markdown-like formatting that the user can type in a message.
+	composerMarkup = []markupDelim{{"```", richCodeBlock, false}, {"**", richBold, false}, {"__", richUnderline, false},
+		{"~~", richStrike, false}, {"||", richSpoiler, false}, {"`", richCode, false}, {"*", richItalic, false},
+		{"_", richItalic, true}}
+	composerLink    = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s)]+)\)`)
+	composerMention = regexp.MustCompile(`<@([^|>\s]+)\|([^>]+)>`)
+	composerEmoji   = regexp.MustCompile(`<:(\w+):([^>\s]+)>`)
+
+	urlPattern = regexp.MustCompile(`https?://[^\s<>]+[^\s<>.,;:!?'")\]]`)
+)
+
+// parseComposed converts the formatting typed into the message entry into rich text.
+func parseComposed(text string) []richSpan {
+	spans := parseMarkup(text, composerMarkup, 0)
+	spans = expandTokens(spans, composerLink, func(match []string) richSpan {
+		return richSpan{text: match[1], link: match[2]}
+	})
+	spans = expandTokens(spans, composerMention, func(match []string) richSpan {
+		return richSpan{text: "@" + match[2], mention: true, userID: match[1]}
+	})
+	spans = expandTokens(spans, composerEmoji, func(match []string) richSpan {
+		return richSpan{text: ":" + match[1] + ":", emojiID: match[2]}
+	})
+	return linkURLs(spans)
+}
+
+// mentionToken returns the text that parseComposed reads as a mention of usr.
+func mentionToken(usr *user) string {
+	return "<@" + usr.id + "|" + usr.displayName() + ">"
+}
+
+// emojiToken returns the text that parseComposed reads as the custom emoji e.
+func emojiToken(e *customEmoji) string {
+	return "<:" + e.name + ":" + e.id + ">"
+}
+
+// plainText returns the text of spans without any formatting.
+func plainText(spans []richSpan) string {
+	var text strings.Builder
+	for _, s := range spans {
+		text.WriteString(s.text)
+	}
+	return text.String()
+}
+
+// formatMarkup writes spans as text using the markers of a service for each style, and its tokens for the rest.
+// Styles that the service has no marker for are dropped.
+func formatMarkup(spans []richSpan, delims []markupDelim, tokens markupTokens) string {
+	var text strings.Builder
+	for _, s := range spans {
+		switch {
+		case s.link != "" && tokens.link != nil:
+			text.WriteString(tokens.link(s.text, s.link))
+			continue
+		case s.userID != "" && tokens.mention != nil:
+			text.WriteString(tokens.mention(s.userID))
+			continue
+		case s.emojiID != "" && tokens.emoji != nil:
+			text.WriteString(tokens.emoji(strings.Trim(s.text, ":"), s.emojiID))
+			continue
+		}
+
+		var marks []string
+		for style := richBold; style <= richSpoiler; style <<= 1 {
+			if s.style&style == 0 {
+				continue
+			}
+			for _, d := range delims {
+				if d.style == style {
+					marks = append(marks, d.mark)
+					break
+				}
+			}
+		}
+
+		for _, m := range marks {
+			text.WriteString(m)
+		}
+		if tokens.escape != nil && s.style&(richCode|richCodeBlock) == 0 {
+			text.WriteString(tokens.escape(s.text))
+		} else {
+			text.WriteString(s.text)
+		}
+		for i := len(marks) - 1; i >= 0; i-- {
+			text.WriteString(marks[i])
+		}
+	}
+	return text.String()
+}
+
+// escapeMarkup puts a backslash before backslashes and the characters of the markers in delims, for services
+// that read a backslash as meaning the next character is text, such as the arm in ¯\_(ツ)_/¯.
+func escapeMarkup(text string, delims []markupDelim) string {
+	special := `\`
+	for _, d := range delims {
+		special += d.mark
+	}
+
+	var out strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(special, r) {
+			out.WriteRune('\\')
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// parseMarkup splits text into spans using the delimiters given, longer markers should be listed first.
+// Text inside code markers is not parsed further.
+func parseMarkup(text string, delims []markupDelim, style richStyle) []richSpan {
+	var spans []richSpan
+	for text != "" {
+		start, end, d := findMarkup(text, delims)
+		if start < 0 {
+			spans = append(spans, richSpan{text: text, style: style})
+			break
+		}
+
+		if start > 0 {
+			spans = append(spans, richSpan{text: text[:start], style: style})
+		}
+		inner := text[start+len(d.mark) : end]
+		if d.style&(richCode|richCodeBlock) != 0 {
+			spans = append(spans, richSpan{text: strings.Trim(inner, "\n"), style: style | d.style})
+		} else {
+			spans = append(spans, parseMarkup(inner, delims, style|d.style)...)
+		}
+		text = text[end+len(d.mark):]
+	}
+	return spans
+}
+
+// findMarkup returns the position of the first delimited section in text and the end marker, or -1 if there is none.
+func findMarkup(text string, delims []markupDelim) (int, int, markupDelim) {
+	for i := 0; i < len(text); i++ {
+		for _, d := range delims {
+			if !strings.HasPrefix(text[i:], d.mark) || escaped(text, i) || (d.word && !wordEdge(text, i, true)) {
+				continue
+			}
+
+			from := i + len(d.mark)
+			for j := from + 1; j+len(d.mark) <= len(text); j++ {
+				if strings.HasPrefix(text[j:], d.mark) && !escaped(text, j) &&
+					(!d.word || wordEdge(text, j+len(d.mark), false)) {
+					return i, j, d
+				}
+			}
+		}
+	}
+	return -1, -1, markupDelim{}
+}
+
+// escaped returns true if the marker at pos follows a backslash, so is meant as text, like the arm in ¯\_(ツ)_/¯.
+func escaped(text string, pos int) bool {
+	return pos > 0 && text[pos-1] == '\\'
+}
+
+// wordEdge returns true if the character before (for an opening marker) or at pos is not part of a word.
+func wordEdge(text string, pos int, opening bool) bool {
+	var r rune
+	if opening {
+		if pos == 0 {
+			return true
+		}
+		r, _ = utf8.DecodeLastRuneInString(text[:pos])
+	} else {
+		if pos >= len(text) {
+			return true
+		}
+		r, _ = utf8.DecodeRuneInString(text[pos:])
+	}
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// expandTokens replaces matches of pattern in the text of spans, other than code, with the span that replace returns.
+// The replacement keeps the style of the text it was found in.
+func expandTokens(spans []richSpan, pattern *regexp.Regexp, replace func(match []string) richSpan) []richSpan {
+	var out []richSpan
+	for _, s := range spans {
+		if s.style&(richCode|richCodeBlock) != 0 || s.token() {
+			out = append(out, s)
+			continue
+		}
+
+		pos := 0
+		for _, loc := range pattern.FindAllStringSubmatchIndex(s.text, -1) {
+			if loc[0] > pos {
+				out = append(out, richSpan{text: s.text[pos:loc[0]], style: s.style})
+			}
+
+			var match []string
+			for i := 0; i < len(loc); i += 2 {
+				if loc[i] < 0 {
+					match = append(match, "")
+				} else {
+					match = append(match, s.text[loc[i]:loc[i+1]])
+				}
+			}
+			token := replace(match)
+			token.style |= s.style
+			out = append(out, token)
+			pos = loc[1]
+		}
+		if pos < len(s.text) {
+			out = append(out, richSpan{text: s.text[pos:], style: s.style})
+		}
+	}
+	return out
+}
+
+// linkURLs turns web addresses in plain text into links.
+func linkURLs(spans []richSpan) []richSpan {
+	return expandTokens(spans, urlPattern, func(match []string) richSpan {
+		return richSpan{text: match[0], link: match[0]}
+	})
+}
+
+// richSegments converts spans into the segments of a RichText widget.
+// Tapping a channel link calls openChannel, an attachment calls openFile with its URI,
+// and tapping a hidden spoiler calls reveal with its index.
+func richSegments(spans []richSpan, openChannel func(*channel), openFile func(string),
+	reveal func(int)) []widget.RichTextSegment {
+	var segs []widget.RichTextSegment
+	for i, s := range spans {
+		i := i
+		switch {
+		case s.style&richSpoiler != 0:
+			segs = append(segs, &widget.HyperlinkSegment{Text: strings.Repeat("▒", utf8.RuneCountInString(s.text)),
+				OnTapped: func() {
+					reveal(i)
+				}})
+		case s.style&richCodeBlock != 0:
+			segs = append(segs, &widget.TextSegment{Style: widget.RichTextStyleCodeBlock, Text: s.text})
+		case s.emoji != "":
+			if uri, err := storage.ParseURI(s.emoji); err == nil {
+				// Fyne draws images as blocks, so emoji sit on their own line
+				segs = append(segs, &widget.ImageSegment{Source: uri, Title: s.text})
+			} else {
+				segs = append(segs, &widget.TextSegment{Style: widget.RichTextStyleInline, Text: s.text})
+			}
+		case s.file != "":
+			file := s.file
+			segs = append(segs, &widget.HyperlinkSegment{Text: s.text, OnTapped: func() {
+				openFile(file)
+			}})
+		case s.channel != nil:
+			ch := s.channel
+			segs = append(segs, &widget.HyperlinkSegment{Text: s.text, OnTapped: func() {
+				openChannel(ch)
+			}})
+		case s.link != "":
+			u, err := url.Parse(s.link)
+			if err != nil {
+				segs = append(segs, &widget.TextSegment{Style: widget.RichTextStyleInline, Text: s.text})
+				continue
+			}
+			segs = append(segs, &widget.HyperlinkSegment{Text: s.text, URL: u})
+		default:
+			segs = append(segs, &widget.TextSegment{Style: richTextStyle(s), Text: s.text})
+		}
+	}
+	return segs
+}
+
+func richTextStyle(s richSpan) widget.RichTextStyle {
+	style := widget.RichTextStyleInline
+	style.TextStyle = fyne.TextStyle{
+		Bold:      s.style&richBold != 0 || s.mention,
+		Italic:    s.style&richItalic != 0,
+		Monospace: s.style&richCode != 0,
+		Underline: s.style&richUnderline != 0,
+	}
+	if s.mention {
+		style.ColorName = theme.ColorNamePrimary
+	} else if s.style&richStrike != 0 { // there is no strike through text style, so we fade it instead
+		style.ColorName = theme.ColorNameDisabled
+	}
+	return style
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseComposed(t *testing.T) {
+	for _, tt := range []struct {
+		name, in string
+		want     []richSpan
+	}{
+		{"plain", "hello", []richSpan{{text: "hello"}}},
+		{"styles", "**bold** and *it*", []richSpan{{text: "bold", style: richBold}, {text: " and "},
+			{text: "it", style: richItalic}}},
+		{"nested", "**bold _both_**", []richSpan{{text: "bold ", style: richBold},
+			{text: "both", style: richBold | richItalic}}},
+		{"word edge", "snake_case_name", []richSpan{{text: "snake_case_name"}}},
+		{"underscore italic", "_it_ here", []richSpan{{text: "it", style: richItalic}, {text: " here"}}},
+		{"escaped", `\*not italic\*`, []richSpan{{text: `\*not italic\*`}}},
+		{"shrug", shrug, []richSpan{{text: shrug}}},
+		{"code", "`*a_b*`", []richSpan{{text: "*a_b*", style: richCode}}},
+		{"code block", "```\nx := 1\n```", []richSpan{{text: "x := 1", style: richCodeBlock}}},
+		{"unclosed", "2 * 3", []richSpan{{text: "2 * 3"}}},
+		{"link", "[site](https://example.com)", []richSpan{{text: "site", link: "https://example.com"}}},
+		{"url", "see https://fyne.io.", []richSpan{{text: "see "}, {text: "https://fyne.io", link: "https://fyne.io"},
+			{text: "."}}},
+		{"mention", "hi <@42|Bob>", []richSpan{{text: "hi "}, {text: "@Bob", mention: true, userID: "42"}}},
+		{"emoji", "<:wave:7>", []richSpan{{text: ":wave:", emojiID: "7"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseComposed(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseComposed(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMarkup(t *testing.T) {
+	discordEscape := markupTokens{escape: func(text string) string {
+		return escapeMarkup(text, discordMarkup)
+	}}
+	for _, tt := range []struct {
+		name, in string
+		delims   []markupDelim
+		tokens   markupTokens
+		want     string
+	}{
+		{"discord", "**bold** and *it*", discordMarkup, markupTokens{}, "**bold** and *it*"},
+		{"nested", "**bold _both_**", discordMarkup, markupTokens{}, "**bold *****both***"},
+		{"whatsapp", "**bold** and _it_", whatsAppMarkup, markupTokens{}, "*bold* and _it_"},
+		{"no marker", "__under__", whatsAppMarkup, markupTokens{}, "under"},
+		{"escaped", "**bold** and snake_case", discordMarkup, discordEscape, `**bold** and snake\_case`},
+		{"shrug", "well " + shrug, discordMarkup, discordEscape, `well ¯\\\_(ツ)\_/¯`},
+		{"code not escaped", "`a_b`", discordMarkup, discordEscape, "`a_b`"},
+		{"link", "[site](https://example.com)", discordMarkup, markupTokens{link: func(text, url string) string {
+			return text + " <" + url + ">"
+		}}, "site <https://example.com>"},
+		{"mention", "<@42|Bob>", discordMarkup, markupTokens{mention: func(id string) string {
+			return "<@" + id + ">"
+		}}, "<@42>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatMarkup(parseComposed(tt.in), tt.delims, tt.tokens); got != tt.want {
+				t.Errorf("formatMarkup(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkupRoundTrip(t *testing.T) {
+	for _, in := range []string{"plain", "**bold** and *it*", "~~gone~~ ||secret||", "**bold _both_**",
+		"snake_case stays", "`a*b`"} {
+		for name, delims := range map[string][]markupDelim{"discord": discordMarkup, "whatsapp": whatsAppMarkup} {
+			spans := parseComposed(in)
+			kept := formatMarkup(spans, delims, markupTokens{})
+			if got := formatMarkup(parseMarkup(kept, delims, 0), delims, markupTokens{}); got != kept {
+				t.Errorf("%s: %q was sent as %q but read back as %q", name, in, kept, got)
+			}
+		}
+	}
+}
+
+func TestEscapeMarkup(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":       "plain",
+		`a*b\c`:       `a\*b\\c`,
+		"snake_case":  `snake\_case`,
+		"~~x~~ ||y||": `\~\~x\~\~ \|\|y\|\|`,
+	} {
+		if got := escapeMarkup(in, discordMarkup); got != want {
+			t.Errorf("escapeMarkup(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	_ "github.com/glebarez/go-sqlite"
+)
+
+const (
+	searchFile    = "fybro-search.sqlite"
+	searchLimit   = 200
+	searchVersion = 1 // increased when the schema changes, so that older indexes are rebuilt
+)
+
+const searchSchema = `
+CREATE TABLE IF NOT EXISTS message (
+	id INTEGER PRIMARY KEY,
+	login TEXT NOT NULL,
+	server TEXT NOT NULL,
+	channel TEXT NOT NULL,
+	direct INTEGER NOT NULL DEFAULT 0,
+	msgid TEXT NOT NULL,
+	channel_name TEXT,
+	author TEXT,
+	content TEXT,
+	sent INTEGER,
+	UNIQUE(login, server, channel, direct, msgid)
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS message_text USING fts5(content, author, content='message', content_rowid='id');
+CREATE TRIGGER IF NOT EXISTS message_added AFTER INSERT ON message BEGIN
+	INSERT INTO message_text(rowid, content, author) VALUES (new.id, new.content, new.author);
+END;
+`
+
+// searchDrop removes an index made with an older schema, it fills again as messages are loaded.
+const searchDrop = `
+DROP TRIGGER IF EXISTS message_added;
+DROP TABLE IF EXISTS message_text;
+DROP TABLE IF EXISTS message;
+`
+
+// searchQuery describes what the user is looking for, empty fields match everything.
+type searchQuery struct {
+	text            string
+	login           string
+	channel, author string
+	from, to        time.Time
+}
+
+// matches checks the filters of a query against a result that a service found remotely.
+func (q searchQuery) matches(r *searchResult) bool {
+	if q.channel != "" && !containsFold(r.channelName, q.channel) {
+		return false
+	}
+	if q.author != "" && !containsFold(r.author, q.author) {
+		return false
+	}
+	if !q.from.IsZero() && r.sent.Before(q.from) {
+		return false
+	}
+	return q.to.IsZero() || r.sent.Before(q.to)
+}
+
+// searchResult is a message that matched a query, with enough information to find it again.
+type searchResult struct {
+	login, server, channel, msgID string
+	channelName, author           string
+	snippet, content              string
+	sent                          time.Time
+	direct                        bool // set if the channel is a direct message, as its id may match a group's
+	remote                        bool // found by the service rather than our index
+}
+
+// searchIndex is a full text index of every message we have loaded, stored so that it grows over time.
+type searchIndex struct {
+	lock sync.Mutex
+	db   *sql.DB
+}
+
+func newSearchIndex(a fyne.App) *searchIndex {
+	path := filepath.Join(a.Storage().RootURI().Path(), searchFile)
+	db, err := sql.Open("sqlite", path)
+	if err == nil {
+		err = createSearchSchema(db)
+	}
+	if err != nil {
+		fyne.LogError("Failed to open search index", err)
+		return &searchIndex{}
+	}
+
+	return &searchIndex{db: db}
+}
+
+// createSearchSchema sets up the tables of the index, dropping them first if they were made by an older version.
+func createSearchSchema(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version < searchVersion {
+		if _, err := db.Exec(searchDrop); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(searchSchema); err != nil {
+		return err
+	}
+	_, err := db.Exec("PRAGMA user_version = " + strconv.Itoa(searchVersion))
+	return err
+}
+
+// update adds any messages loaded since the last update to the index.
+func (s *searchIndex) update(servers []*server) {
+	if s.db == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		fyne.LogError("Failed to update search index", err)
+		return
+	}
+	insert, err := tx.Prepare(`INSERT OR IGNORE INTO message
+		(login, server, channel, direct, msgid, channel_name, author, content, sent)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		fyne.LogError("Failed to update search index", err)
+		_ = tx.Rollback()
+		return
+	}
+	defer insert.Close()
+
+	for _, srv := range servers {
+		for _, ch := range srv.channels {
+			for _, m := range ch.unindexed() {
+				if m.id == "" {
+					continue
+				}
+
+				_, err = insert.Exec(srv.login, srv.id, ch.id, ch.direct, m.id, ch.name, m.authorName(), m.content,
+					m.sent.Unix())
+				if err != nil {
+					fyne.LogError("Failed to index message", err)
+				}
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		fyne.LogError("Failed to save search index", err)
+	}
+}
+
+// find returns the most recent messages matching the query.
+func (s *searchIndex) find(q searchQuery) ([]*searchResult, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+
+	var where []string
+	var args []interface{}
+	from := "message m"
+	snippet := "m.content"
+	if match := searchTerms(q.text); match != "" {
+		from = "message_text JOIN message m ON m.id = message_text.rowid"
+		snippet = "snippet(message_text, 0, '', '', '…', 16)"
+		where = append(where, "message_text MATCH ?")
+		args = append(args, match)
+	}
+	if q.login != "" {
+		where = append(where, "m.login = ?")
+		args = append(args, q.login)
+	}
+	if q.channel != "" {
+		where = append(where, "m.channel_name LIKE ?")
+		args = append(args, "%"+q.channel+"%")
+	}
+	if q.author != "" {
+		where = append(where, "m.author LIKE ?")
+		args = append(args, "%"+q.author+"%")
+	}
+	if !q.from.IsZero() {
+		where = append(where, "m.sent >= ?")
+		args = append(args, q.from.Unix())
+	}
+	if !q.to.IsZero() {
+		where = append(where, "m.sent < ?")
+		args = append(args, q.to.Unix())
+	}
+
+	query := "SELECT m.login, m.server, m.channel, m.direct, m.msgid, m.channel_name, m.author, " + snippet +
+		", m.content, m.sent FROM " + from
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY m.sent DESC LIMIT ?"
+	args = append(args, searchLimit)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*searchResult
+	for rows.Next() {
+		r := &searchResult{}
+		var sent int64
+		err = rows.Scan(&r.login, &r.server, &r.channel, &r.direct, &r.msgID, &r.channelName, &r.author, &r.snippet,
+			&r.content, &sent)
+		if err != nil {
+			return nil, err
+		}
+		r.sent = time.Unix(sent, 0)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// mergeResults combines local and remote results, removing duplicates and putting the newest first.
+func mergeResults(local, remote []*searchResult) []*searchResult {
+	seen := make(map[string]bool)
+	var merged []*searchResult
+	for _, r := range append(local, remote...) {
+		key := r.login + "\x00" + channelKey(r.server, r.channel, r.direct) + "\x00" + r.msgID
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, r)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].sent.After(merged[j].sent)
+	})
+	return merged
+}
+
+func containsFold(s, sub string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+}
+
+// searchTerms turns user input into a full text query, each word must match the start of a word in a message.
+func searchTerms(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchTerms(t *testing.T) {
+	for in, want := range map[string]string{
+		"":              "",
+		"hello":         `"hello"*`,
+		"  two  words ": `"two"* "words"*`,
+		`say "hi"`:      `"say"* """hi"""*`,
+		"OR":            `"OR"*`,
+	} {
+		if got := searchTerms(in); got != want {
+			t.Errorf("searchTerms(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMergeResults(t *testing.T) {
+	now := time.Now()
+	local := []*searchResult{{login: "a", server: "s", channel: "1", msgID: "5", sent: now.Add(-time.Hour)}}
+	remote := []*searchResult{
+		{login: "a", server: "s", channel: "1", msgID: "5", sent: now.Add(-time.Hour), remote: true},
+		{login: "a", server: "s", channel: "1", msgID: "5", sent: now, direct: true, remote: true},
+	}
+
+	merged := mergeResults(local, remote)
+	if len(merged) != 2 {
+		t.Fatalf("got %d results, want 2", len(merged))
+	}
+	if !merged[0].direct || merged[1].remote {
+		t.Errorf("want the newer direct message first and the duplicate from our index kept")
+	}
+}
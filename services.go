@@ -7,10 +7,24 @@ import (
 )
 
 type service interface {
+	bio(*user) (string, error)
+	commands() []*command
 	configure(*ui) (fyne.CanvasObject, func(prefix string, a fyne.App))
+	createGroup(name string, people []*user) (*channel, error)
+	directChannel(*user) (*channel, error)
 	disconnect()
+	emojis(*server) ([]*customEmoji, error)
+	history(*channel) ([]*message, error)
+	join(link string) (*channel, error)
+	leave(*channel) error
+	leaveServer(*server) error
 	login(prefix string, u *ui)
-	send(*channel, string)
+	members(*channel) ([]*member, error)
+	pinned(*channel) ([]*message, error)
+	search(searchQuery) ([]*searchResult, error)
+	send(*channel, []richSpan) error
+	setChannelFlag(*channel, channelFlag, bool) error
+	setPinned(*message, bool) error
 }
 
 var (
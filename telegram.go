@@ -2,10 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf16"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/dialog"
@@ -14,24 +21,135 @@ import (
 	"github.com/celestix/gotgproto/ext"
 	"github.com/celestix/gotgproto/sessionMaker"
 	"github.com/glebarez/sqlite"
+	"github.com/gotd/td/telegram/auth"
 	msg2 "github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/message/entity"
+	"github.com/gotd/td/telegram/message/styling"
 	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
 )
 
-const prefTelegramTelKey = "auth.tel"
+const (
+	prefTelegramTelKey     = "auth.tel"
+	prefTelegramSessionKey = "sess.file"
+
+	telegramLegacySession = "fybro-telegram.sqlite"
+	telegramPingInterval  = 30 * time.Second
+	telegramPingTimeout   = 15 * time.Second
+
+	telegramArchiveFolder = 1   // the folder that archived dialogs are moved to
+	telegramMemberLimit   = 200 // the most participants Telegram returns at once
+	telegramDialogPage    = 100 // how many dialogs to ask for at a time
+	telegramRecentChats   = 20  // how many of the newest chats have their messages loaded when we connect
+)
+
+// dialogKind describes a Telegram chat in the terms that folders use to choose the chats they include.
+type dialogKind int
+
+const (
+	kindContact dialogKind = 1 << iota
+	kindNonContact
+	kindGroup
+	kindBroadcast
+	kindBot
+)
+
+// telegramFolder is a dialog filter set up by the user on Telegram, shown as a section of our channel list.
+type telegramFolder struct {
+	title            string
+	kinds            dialogKind // the kinds of chat it includes, unless they are excluded
+	include, exclude []tg.InputPeerClass
+	excludeMuted     bool
+	excludeArchived  bool
+}
 
 type telegram struct {
 	app     fyne.App
 	ip      string
 	proto   *gotgproto.Client
 	context *ext.Context
+	status  *connection
 
-	server *server
-	ui     *ui
+	server        *server
+	inputUsers    map[int64]*tg.InputUser    // how to address users that we might mention, guarded by userLock
+	inputChannels map[int64]*tg.InputChannel // how to address supergroups and broadcast channels, guarded by userLock
+	folders       []telegramFolder           // in the order the user sorted them, guarded by userLock
+	kinds         map[*channel]dialogKind    // which folders each chat can be in, guarded by userLock
+	ui            *ui
 }
 
 func initTelegram(a fyne.App) service {
-	return &telegram{app: a, ip: telegramDefaultIP}
+	return &telegram{app: a, ip: telegramDefaultIP, inputUsers: make(map[int64]*tg.InputUser),
+		inputChannels: make(map[int64]*tg.InputChannel), kinds: make(map[*channel]dialogKind)}
+}
+
+// bio loads what the user wrote about themselves on their profile.
+func (t *telegram) bio(usr *user) (string, error) {
+	if t.proto == nil {
+		return "", errors.New("not connected")
+	}
+
+	id, _ := strconv.ParseInt(usr.id, 10, 64)
+	userLock.RLock()
+	input, ok := t.inputUsers[id]
+	userLock.RUnlock()
+	if !ok {
+		return "", errors.New("unknown user " + usr.displayName())
+	}
+	full, err := t.context.Raw.UsersGetFullUser(t.context, input)
+	if err != nil {
+		return "", err
+	}
+	return full.FullUser.About, nil
+}
+
+// commands changes your profile name and the description of group chats on Telegram.
+func (t *telegram) commands() []*command {
+	return []*command{
+		{name: "nick", args: "<first> [last]", help: "Change the name on your Telegram profile",
+			run: func(_ *channel, args string) (string, error) {
+				if t.proto == nil {
+					return "", errors.New("not connected")
+				}
+				if args == "" {
+					return "", errors.New("type the name to use, such as /nick Ada Lovelace")
+				}
+
+				first, last := args, ""
+				if space := strings.Index(args, " "); space > 0 {
+					first, last = args[:space], args[space+1:]
+				}
+				req := &tg.AccountUpdateProfileRequest{}
+				req.SetFirstName(first)
+				req.SetLastName(last)
+				_, err := t.context.Raw.AccountUpdateProfile(t.context, req)
+				return "", err
+			}},
+		{name: "topic", args: "[description]", help: "Show or change the description of this group",
+			run: func(ch *channel, args string) (string, error) {
+				if t.proto == nil {
+					return "", errors.New("not connected")
+				}
+				if ch.direct {
+					return "", errors.New("only groups have a description")
+				}
+
+				if args != "" {
+					_, err := t.context.Raw.MessagesEditChatAbout(t.context, &tg.MessagesEditChatAboutRequest{
+						Peer: t.peer(ch), About: args})
+					return "", err
+				}
+
+				full, err := t.fullChat(ch)
+				if err != nil {
+					return "", err
+				}
+				if about := full.FullChat.GetAbout(); about != "" {
+					return about, nil
+				}
+				return ch.name + " has no description", nil
+			}},
+	}
 }
 
 func (t *telegram) configure(u *ui) (fyne.CanvasObject, func(prefix string, a fyne.App)) {
@@ -46,50 +164,256 @@ func (t *telegram) configure(u *ui) (fyne.CanvasObject, func(prefix string, a fy
 			}
 
 			a.Preferences().SetString(prefix+prefTelegramTelKey, tel.Text)
+			a.Preferences().SetString(prefix+prefTelegramSessionKey, telegramSessionFile(prefix))
 			t.login(prefix, u)
 		}
 }
 
 func (t *telegram) disconnect() {
-	t.proto.Stop()
+	if t.status != nil {
+		t.status.close()
+	}
+	if t.proto != nil {
+		t.proto.Stop()
+	}
 }
 
+// emojis lists the custom emoji in the sets the user has added, only premium accounts can send them.
+// They are named after their set so that they can be completed like other custom emoji.
+func (t *telegram) emojis(*server) ([]*customEmoji, error) {
+	if t.proto == nil {
+		return nil, errors.New("not connected")
+	}
+	if !t.context.Self.Premium {
+		return nil, nil
+	}
+
+	ret, err := t.context.Raw.MessagesGetEmojiStickers(t.context, 0)
+	if err != nil {
+		return nil, err
+	}
+	all, ok := ret.AsModified()
+	if !ok {
+		return nil, nil
+	}
+
+	var list []*customEmoji
+	for _, set := range all.Sets {
+		ret, err := t.context.Raw.MessagesGetStickerSet(t.context, &tg.MessagesGetStickerSetRequest{
+			Stickerset: &tg.InputStickerSetID{ID: set.ID, AccessHash: set.AccessHash}})
+		if err != nil {
+			fyne.LogError("Failed to load emoji set "+set.Title, err)
+			continue
+		}
+		full, ok := ret.AsModified()
+		if !ok {
+			continue
+		}
+
+		for i, data := range full.Documents {
+			doc, ok := data.AsNotEmpty()
+			if !ok {
+				continue
+			}
+			for _, attr := range doc.Attributes {
+				if e, ok := attr.(*tg.DocumentAttributeCustomEmoji); ok {
+					list = append(list, &customEmoji{id: strconv.FormatInt(doc.ID, 10),
+						name: set.ShortName + "_" + strconv.Itoa(i+1), alt: e.Alt})
+				}
+			}
+		}
+	}
+	return list, nil
+}
+
+// getUser returns the user with id, asking the server about people we have not seen.
+// If that fails a placeholder is returned so that callers always have someone to show.
 func (t *telegram) getUser(id int64) *user {
 	uid := strconv.Itoa(int(id))
-	if usr, found := t.server.users[uid]; found {
+	userLock.RLock()
+	usr, found := t.server.users[uid]
+	userLock.RUnlock()
+	if found {
 		return usr
 	}
 
+	unknown := &user{id: uid, name: "someone", username: uid} // not remembered, so we ask again next time
 	data, err := t.context.Raw.UsersGetUsers(t.context, []tg.InputUserClass{&tg.InputUser{UserID: id}})
 	if err != nil || len(data) == 0 {
 		fyne.LogError("Failed to download user info", err)
-		return nil
+		return unknown
 	}
 
-	u, _ := data[0].AsNotEmpty()
-	user := &user{username: u.Username, name: userDisplayName(u)}
-	//if u.Photo.(mtproto.TL_userProfilePhoto).Photo_small != nil {
-	//	time.Sleep(time.Second*10)
-	//	p := u.Photo.(mtproto.TL_userProfilePhoto).Photo_small.(mtproto.TL_fileLocation)
-	//	l := &mtproto.TL_inputFileLocation{
-	//		Secret: p.Secret,
-	//		Local_id: p.Local_id,
-	//		Volume_id: p.Volume_id,
-	//	}
-	//	f, err := t.proto.UploadGetFile(l, 0)
-	//	log.Println("F", f, err)
-	//}
+	u, ok := data[0].AsNotEmpty()
+	if !ok {
+		return unknown
+	}
+	return t.addUser(u)
+}
 
-	t.server.users[uid] = user
-	return user
+// addUser remembers a user that the server told us about, so that we can show and mention them.
+func (t *telegram) addUser(u *tg.User) *user {
+	usr := &user{id: strconv.Itoa(int(u.ID)), username: u.Username, name: userDisplayName(u)}
+	userLock.Lock()
+	defer userLock.Unlock()
+	if known, ok := t.server.users[usr.id]; ok {
+		usr = known
+	} else {
+		t.server.users[usr.id] = usr
+	}
+	if u.Status != nil {
+		usr.presence = telegramPresence(u.Status)
+	}
+	if photo, ok := u.Photo.(*tg.UserProfilePhoto); ok {
+		usr.avatarURL = t.avatarURI("user", u.ID, photo.PhotoID)
+	}
+	t.inputUsers[u.ID] = u.AsInput()
+	return usr
+}
+
+// telegramPresence returns how a Telegram user status is shown, people last seen recently are away.
+func telegramPresence(status tg.UserStatusClass) presence {
+	switch status.(type) {
+	case *tg.UserStatusOnline:
+		return presenceOnline
+	case *tg.UserStatusRecently:
+		return presenceAway
+	case *tg.UserStatusEmpty:
+		return presenceUnknown
+	}
+	return presenceOffline
+}
+
+// directChannel returns the conversation with usr, adding it to our chats if we have not talked before.
+func (t *telegram) directChannel(usr *user) (*channel, error) {
+	if usr == nil {
+		return nil, errors.New("no user to talk to")
+	}
+	if ch := findServerChan(t.server, usr.id); ch != nil && ch.direct {
+		return ch, nil
+	}
+
+	ch := &channel{name: usr.displayName(), id: usr.id, direct: true, server: t.server}
+	t.setKind(ch, kindNonContact)
+	t.server.channels = append(t.server.channels, ch)
+	if t.context != nil {
+		ch.appendNew(t.loadMessages(t.context, ch))
+	}
+	return ch, nil
+}
+
+// members lists the participants of a group chat with the owner and admins marked, or both people in a direct conversation.
+func (t *telegram) members(ch *channel) ([]*member, error) {
+	if t.proto == nil {
+		return nil, errors.New("not connected")
+	}
+
+	id, _ := strconv.Atoi(ch.id)
+	if ch.direct {
+		return []*member{{user: t.getUser(int64(id))}, {user: t.getUser(t.context.Self.ID)}}, nil
+	}
+
+	if input := t.inputChannel(ch); input != nil {
+		return t.channelMembers(input)
+	}
+
+	full, err := t.context.Raw.MessagesGetFullChat(t.context, int64(id))
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[int64]string)
+	if chat, ok := full.FullChat.(*tg.ChatFull); ok {
+		if parts, ok := chat.Participants.(*tg.ChatParticipants); ok {
+			for _, p := range parts.Participants {
+				switch p := p.(type) {
+				case *tg.ChatParticipantCreator:
+					roles[p.UserID] = "Owner"
+				case *tg.ChatParticipantAdmin:
+					roles[p.UserID] = "Admin"
+				}
+			}
+		}
+	}
+
+	var list []*member
+	for _, data := range full.Users {
+		if u, ok := data.AsNotEmpty(); ok {
+			m := &member{user: t.addUser(u)}
+			if role, ok := roles[u.ID]; ok {
+				m.roles = []string{role}
+			}
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+// channelMembers lists the recent participants of a supergroup or channel, with the owner and admins marked.
+func (t *telegram) channelMembers(input *tg.InputChannel) ([]*member, error) {
+	ret, err := t.context.Raw.ChannelsGetParticipants(t.context, &tg.ChannelsGetParticipantsRequest{
+		Channel: input, Filter: &tg.ChannelParticipantsRecent{}, Limit: telegramMemberLimit})
+	if err != nil {
+		return nil, err
+	}
+	parts, ok := ret.AsModified()
+	if !ok {
+		return nil, nil
+	}
+
+	roles := make(map[int64]string)
+	for _, p := range parts.Participants {
+		switch p := p.(type) {
+		case *tg.ChannelParticipantCreator:
+			roles[p.UserID] = "Owner"
+		case *tg.ChannelParticipantAdmin:
+			roles[p.UserID] = "Admin"
+		}
+	}
+	var list []*member
+	for _, data := range parts.Users {
+		if u, ok := data.AsNotEmpty(); ok {
+			m := &member{user: t.addUser(u)}
+			if role, ok := roles[u.ID]; ok {
+				m.roles = []string{role}
+			}
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+// fullChat loads the details of a group, supergroup or channel.
+func (t *telegram) fullChat(ch *channel) (*tg.MessagesChatFull, error) {
+	if input := t.inputChannel(ch); input != nil {
+		return t.context.Raw.ChannelsGetFullChannel(t.context, input)
+	}
+	id, _ := strconv.ParseInt(ch.id, 10, 64)
+	return t.context.Raw.MessagesGetFullChat(t.context, id)
 }
 
 func (t *telegram) login(prefix string, u *ui) {
 	t.ui = u
+	t.status = newConnection(u.connectionChanged)
+	num := t.app.Preferences().String(prefix + prefTelegramTelKey)
+	t.addServer(accountName(t.app, prefix, num), prefix, u)
+
+	t.status.reconnect(func() error {
+		return t.connect(prefix, u)
+	})
+}
+
+// connect starts a new client for the login at prefix, loading channels the first time it succeeds.
+// It is used as the dial function for our connection status so may be called many times.
+func (t *telegram) connect(prefix string, u *ui) error {
 	p := t.app.Preferences()
 	num := p.String(prefix + prefTelegramTelKey)
 
-	path := filepath.Join(fyne.CurrentApp().Storage().RootURI().Path(), "fybro-telegram.sqlite")
+	file := p.String(prefix + prefTelegramSessionKey)
+	if file == "" { // logins from before multiple accounts shared a single session
+		file = telegramLegacySession
+		p.SetString(prefix+prefTelegramSessionKey, file)
+	}
+	path := filepath.Join(fyne.CurrentApp().Storage().RootURI().Path(), file)
 	client, err := gotgproto.NewClient(
 		telegramAppID,
 		telegramAppHash,
@@ -98,104 +422,510 @@ func (t *telegram) login(prefix string, u *ui) {
 			AuthConversator: &inputGetter{num: num},
 			Session:         sessionMaker.SqlSession(sqlite.Open(path)),
 			InMemory:        false,
+			RunMiddleware:   t.run,
 		},
 	)
 
 	if err != nil {
-		fyne.LogError("Connect failed", err)
-		return
+		if auth.IsUnauthorized(err) || errors.Is(err, errAuthRequired) {
+			return fmt.Errorf("%w: %v", errAuthRequired, err)
+		}
+		return err
 	}
 
+	reconnected := t.proto != nil
 	t.proto = client
 	t.context = client.CreateContext()
+	t.server.account = accountName(t.app, prefix, userDisplayName(t.context.Self))
+	addTelegramFiles(t)
 
 	client.Dispatcher.AddHandler(&updateHandler{t: t, u: u})
 	go func() {
 		client.Idle()
 	}()
+	go t.watch(client, t.context)
 
-	t.loadServers(t.context, prefix, u)
+	if reconnected {
+		go t.resync(t.context, u)
+	} else {
+		go t.loadChannels(t.context, u)
+	}
+	return nil
 }
 
-func (t *telegram) loadServers(s *ext.Context, prefix string, u *ui) {
-	srv := &server{service: t, name: "Telegram", iconResource: resourceTelegramPng}
+func (t *telegram) addServer(account, prefix string, u *ui) {
+	srv := &server{service: t, name: "Telegram", account: account, login: prefix, iconResource: resourceTelegramPng,
+		status: t.status}
 	srv.users = make(map[string]*user)
 	t.server = srv
+	u.addServers(srv)
+}
 
-	if u.data == nil {
-		u.data = &appData{}
+func (t *telegram) loadChannels(s *ext.Context, u *ui) {
+	t.loadFolders(s)
+	var first *channel
+	for _, folder := range []int{0, telegramArchiveFolder} {
+		t.loadDialogs(s, folder, func(ch *channel) {
+			if first == nil {
+				first = ch
+				t.loadFirstChannel(s, ch, u)
+			}
+		})
+		u.channels.Refresh()
 	}
-	u.data.servers = append(u.data.servers, srv)
-	if len(u.data.servers) > 0 {
-		u.currentServer = u.data.servers[0]
-		u.servers.Select(0)
+	migrateChannelKeys(t.server)
+	u.channels.Refresh()
+
+	// the rest are loaded when they are opened, asking for them all at once runs into Telegram's flood limits
+	for i, c := range t.server.channels {
+		if i >= telegramRecentChats {
+			break
+		} else if c == first {
+			continue // we did this one above
+		}
+		c.loaded = true
+		u.messagesAdded(c, c.appendNew(t.loadMessages(s, c)))
 	}
-	u.servers.Refresh()
+}
+
+// loadDialogs pages through the chats in a dialog folder, adding each to our server and passing it to added.
+func (t *telegram) loadDialogs(s *ext.Context, folder int, added func(*channel)) {
+	req := &tg.MessagesGetDialogsRequest{OffsetPeer: &tg.InputPeerEmpty{}, Limit: telegramDialogPage}
+	req.SetFolderID(folder)
+	seen := 0
+	for {
+		ret, err := s.Raw.MessagesGetDialogs(s, req)
+		if err != nil {
+			fyne.LogError("Failed to load Telegram chats", err)
+			return
+		}
+		page, ok := ret.AsModified()
+		if !ok || len(page.GetDialogs()) == 0 {
+			return
+		}
+
+		users := make(map[int64]*tg.User)
+		for _, data := range page.GetUsers() {
+			if u, ok := data.AsNotEmpty(); ok {
+				users[u.ID] = u
+			}
+		}
+		chats := make(map[int64]tg.ChatClass)
+		for _, c := range page.GetChats() {
+			chats[c.GetID()] = c
+		}
+		dates := make(map[string]int) // when the newest message of each dialog was sent, for the next page
+		for _, data := range page.GetMessages() {
+			switch m := data.(type) {
+			case *tg.Message:
+				dates[strconv.FormatInt(peerID(m.PeerID), 10)+"/"+strconv.Itoa(m.ID)] = m.Date
+			case *tg.MessageService:
+				dates[strconv.FormatInt(peerID(m.PeerID), 10)+"/"+strconv.Itoa(m.ID)] = m.Date
+			}
+		}
+
+		applyDialogSettings(t.server, page.GetDialogs())
+		var last *tg.Dialog
+		for _, d := range page.GetDialogs() {
+			dialog, ok := d.(*tg.Dialog)
+			if !ok {
+				continue
+			}
+			last = dialog
+
+			var ch *channel
+			if p, ok := dialog.Peer.(*tg.PeerUser); ok {
+				if u, ok := users[p.UserID]; ok {
+					ch = t.addDirect(u)
+				}
+			} else if chat, ok := chats[peerID(dialog.Peer)]; ok {
+				ch = t.addChat(chat)
+			}
+			if ch != nil {
+				added(ch)
+			}
+		}
 
-	// try group chats
-	ret, err := s.Raw.MessagesGetDialogs(s, &tg.MessagesGetDialogsRequest{OffsetPeer: &tg.InputPeerEmpty{}})
+		seen += len(page.GetDialogs())
+		slice, more := ret.(*tg.MessagesDialogsSlice)
+		if !more || seen >= slice.Count || last == nil {
+			return
+		}
+		id := peerID(last.Peer)
+		req.OffsetID = last.TopMessage
+		req.OffsetDate = dates[strconv.FormatInt(id, 10)+"/"+strconv.Itoa(last.TopMessage)]
+		if u, ok := users[id]; ok && isUserPeer(last.Peer) {
+			req.OffsetPeer = u.AsInputPeer()
+		} else if c, ok := chats[id].(*tg.Channel); ok {
+			req.OffsetPeer = c.AsInputPeer()
+		} else {
+			req.OffsetPeer = &tg.InputPeerChat{ChatID: id}
+		}
+	}
+}
+
+// addChat adds a channel for a group, supergroup or broadcast channel to our server, returning the one we have if
+// it is already known. It returns nil for chats that we have left or been removed from.
+func (t *telegram) addChat(c tg.ChatClass) *channel {
+	var ch *channel
+	kind := kindGroup
+	switch chat := c.(type) {
+	case *tg.Chat:
+		if chat.Left || chat.Deactivated {
+			return nil
+		}
+		ch = &channel{name: chat.Title, id: strconv.Itoa(int(chat.ID)), server: t.server}
+		t.addChatUser(chat.ID, chat.Title, "", chat.Photo)
+	case *tg.Channel:
+		if chat.Left {
+			return nil
+		}
+		ch = &channel{name: chat.Title, id: strconv.Itoa(int(chat.ID)), server: t.server}
+		if chat.Broadcast {
+			kind = kindBroadcast
+		}
+
+		userLock.Lock()
+		t.inputChannels[chat.ID] = chat.AsInput()
+		userLock.Unlock()
+		t.addChatUser(chat.ID, chat.Title, chat.Username, chat.Photo)
+	default:
+		return nil
+	}
+
+	if known := t.groupChannel(ch.id); known != nil {
+		return known
+	}
+	t.setKind(ch, kind)
+	t.server.channels = append(t.server.channels, ch)
+	return ch
+}
+
+// addChatUser remembers a chat as the author of its messages that have no sender, such as posts in broadcast
+// channels, so that they show the name and photo of the chat.
+func (t *telegram) addChatUser(id int64, title, username string, photo tg.ChatPhotoClass) {
+	uid := strconv.FormatInt(id, 10)
+	userLock.Lock()
+	defer userLock.Unlock()
+	usr, ok := t.server.users[uid]
+	if !ok {
+		usr = &user{id: uid, name: title, username: username}
+		t.server.users[uid] = usr
+	}
+	if p, ok := photo.(*tg.ChatPhoto); ok {
+		usr.avatarURL = t.avatarURI("chat", id, p.PhotoID)
+	}
+}
+
+// addDirect adds the conversation with u to our server, returning the one we have if it is already known.
+func (t *telegram) addDirect(u *tg.User) *channel {
+	usr := t.addUser(u)
+	if ch := t.peerChannel(&tg.PeerUser{UserID: u.ID}); ch != nil {
+		return ch
+	}
+
+	ch := &channel{name: usr.displayName(), id: usr.id, direct: true, server: t.server}
+	kind := kindNonContact
+	if u.Bot {
+		kind = kindBot
+	} else if u.Contact {
+		kind = kindContact
+	}
+	t.setKind(ch, kind)
+	t.server.channels = append(t.server.channels, ch)
+	return ch
+}
+
+// setKind records what kind of chat ch is and puts it in the section for its folder.
+func (t *telegram) setKind(ch *channel, kind dialogKind) {
+	userLock.Lock()
+	t.kinds[ch] = kind
+	userLock.Unlock()
+	ch.category = t.category(ch)
+}
+
+// category returns the title of the first folder that includes ch, or the section for its kind of chat if none do.
+func (t *telegram) category(ch *channel) string {
+	id, _ := strconv.ParseInt(ch.id, 10, 64)
+	hasPeer := func(list []tg.InputPeerClass) bool {
+		for _, p := range list {
+			if pid, direct := inputPeerID(p); pid == id && direct == ch.direct {
+				return true
+			}
+		}
+		return false
+	}
+
+	userLock.RLock()
+	defer userLock.RUnlock()
+	kind := t.kinds[ch]
+	for _, f := range t.folders {
+		if hasPeer(f.exclude) || (f.excludeMuted && ch.hasFlag(flagMuted)) ||
+			(f.excludeArchived && ch.hasFlag(flagArchived)) {
+			continue
+		}
+		if hasPeer(f.include) || f.kinds&kind != 0 {
+			return f.title
+		}
+	}
+
+	switch {
+	case ch.direct:
+		return directSection
+	case kind == kindBroadcast:
+		return channelsSection
+	}
+	return groupsSection
+}
+
+// loadFolders fetches the folders the user sorts their chats into on Telegram.
+func (t *telegram) loadFolders(s *ext.Context) {
+	ret, err := s.Raw.MessagesGetDialogFilters(s)
 	if err != nil {
-		fyne.LogError("Unknown protocol error", err)
+		fyne.LogError("Failed to load Telegram folders", err)
+		return
 	}
-	for _, c := range ret.(*tg.MessagesDialogsSlice).Chats {
-		chat := c.(*tg.Chat)
-		chn := &channel{name: chat.Title, id: strconv.Itoa(int(chat.ID)), direct: false, server: srv}
 
-		if len(srv.channels) == 0 {
-			id, _ := strconv.Atoi(chn.id)
-			chn.messages = t.loadMessages(s, int64(id), false)
-			if srv == u.currentServer {
-				u.setChannel(chn)
+	var folders []telegramFolder
+	for _, f := range ret.Filters {
+		switch f := f.(type) {
+		case *tg.DialogFilter:
+			folder := telegramFolder{title: f.Title, exclude: f.ExcludePeers, excludeMuted: f.ExcludeMuted,
+				excludeArchived: f.ExcludeArchived,
+				include:         append(append([]tg.InputPeerClass{}, f.PinnedPeers...), f.IncludePeers...)}
+			for _, k := range []struct {
+				on   bool
+				kind dialogKind
+			}{{f.Contacts, kindContact}, {f.NonContacts, kindNonContact}, {f.Groups, kindGroup},
+				{f.Broadcasts, kindBroadcast}, {f.Bots, kindBot}} {
+				if k.on {
+					folder.kinds |= k.kind
+				}
 			}
+			folders = append(folders, folder)
+		case *tg.DialogFilterChatlist:
+			folders = append(folders, telegramFolder{title: f.Title,
+				include: append(append([]tg.InputPeerClass{}, f.PinnedPeers...), f.IncludePeers...)})
 		}
-		srv.channels = append(srv.channels, chn)
 	}
-	u.channels.Refresh()
+	userLock.Lock()
+	t.folders = folders
+	userLock.Unlock()
+}
+
+// applyFolders moves each chat to the section of its folder, after the folders or the chats in them change.
+func (t *telegram) applyFolders() {
+	for _, ch := range t.server.channels {
+		ch.category = t.category(ch)
+	}
+	t.ui.channels.Refresh()
+}
+
+// groupChannel returns the group or channel with id that we have listed, or nil.
+// Telegram ids are only unique for each kind of chat, so this leaves out direct messages.
+func (t *telegram) groupChannel(id string) *channel {
+	for _, c := range t.server.channels {
+		if c.id == id && !c.direct {
+			return c
+		}
+	}
+	return nil
+}
+
+// peerChannel returns the channel we list for the chat that p refers to, or nil.
+func (t *telegram) peerChannel(p tg.PeerClass) *channel {
+	id := strconv.FormatInt(peerID(p), 10)
+	if !isUserPeer(p) {
+		return t.groupChannel(id)
+	}
+
+	for _, c := range t.server.channels {
+		if c.id == id && c.direct {
+			return c
+		}
+	}
+	return nil
+}
+
+// peer returns how to address the chat of ch, supergroups and channels need the access hash we were sent.
+func (t *telegram) peer(ch *channel) tg.InputPeerClass {
+	id, _ := strconv.ParseInt(ch.id, 10, 64)
+	userLock.RLock()
+	defer userLock.RUnlock()
+	if ch.direct {
+		if input, ok := t.inputUsers[id]; ok {
+			return &tg.InputPeerUser{UserID: id, AccessHash: input.AccessHash}
+		}
+	} else if input, ok := t.inputChannels[id]; ok {
+		return &tg.InputPeerChannel{ChannelID: id, AccessHash: input.AccessHash}
+	}
+	return inputPeer(id, ch.direct)
+}
+
+// inputChannel returns how to address ch as a supergroup or channel, or nil if it is a basic group.
+func (t *telegram) inputChannel(ch *channel) *tg.InputChannel {
+	id, _ := strconv.ParseInt(ch.id, 10, 64)
+	userLock.RLock()
+	defer userLock.RUnlock()
+	if ch.direct {
+		return nil
+	}
+	return t.inputChannels[id]
+}
 
-	// direct messages
-	contacts, err := s.Raw.ContactsGetTopPeers(s, &tg.ContactsGetTopPeersRequest{Correspondents: true})
-	if contacts != nil {
-		for _, c := range contacts.(*tg.ContactsTopPeers).Users {
-			chat, _ := c.AsNotEmpty()
-			chn := &channel{name: userDisplayName(chat), id: strconv.Itoa(int(chat.ID)), direct: true, server: srv}
-
-			if len(srv.channels) == 0 {
-				cid, _ := strconv.Atoi(chn.id)
-				chn.messages = t.loadMessages(s, int64(cid), true)
-				if srv == u.currentServer {
-					u.setChannel(chn)
+// join opens a group from an invite link, or a public group or channel from its link or @username.
+func (t *telegram) join(link string) (*channel, error) {
+	if t.proto == nil {
+		return nil, errors.New("not connected")
+	}
+
+	link = strings.TrimPrefix(strings.TrimPrefix(link, "https://"), "http://")
+	for _, prefix := range []string{"t.me/", "telegram.me/", "@"} {
+		link = strings.TrimPrefix(link, prefix)
+	}
+	var chats []tg.ChatClass
+	if hash := strings.TrimPrefix(strings.TrimPrefix(link, "joinchat/"), "+"); hash != link {
+		up, err := t.context.Raw.MessagesImportChatInvite(t.context, hash)
+		if err != nil {
+			return nil, err
+		}
+		chats = updatedChats(up)
+	} else {
+		found, err := t.context.Raw.ContactsResolveUsername(t.context, link)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range found.Chats {
+			if pub, ok := c.(*tg.Channel); ok {
+				up, err := t.context.Raw.ChannelsJoinChannel(t.context, pub.AsInput())
+				if err != nil {
+					return nil, err
 				}
+				chats = append(chats, updatedChats(up)...)
 			}
-			srv.channels = append(srv.channels, chn)
 		}
 	}
-	u.channels.Refresh()
 
-	for i, c := range srv.channels {
-		if i == 0 {
-			continue // we did this one above
+	for _, c := range chats {
+		if ch := t.addChat(c); ch != nil {
+			ch.appendNew(t.loadMessages(t.context, ch))
+			return ch, nil
 		}
-		id, _ := strconv.Atoi(c.id)
-		c.messages = t.loadMessages(s, int64(id), c.direct)
 	}
+	return nil, errors.New(link + " is not a group or channel")
 }
 
-func (t *telegram) loadMessages(s *ext.Context, id int64, direct bool) []*message {
-	var nid tg.InputPeerClass
-	if direct {
-		nid = &tg.InputPeerUser{UserID: id}
+// createGroup starts a group chat called name with people.
+func (t *telegram) createGroup(name string, people []*user) (*channel, error) {
+	if t.proto == nil {
+		return nil, errors.New("not connected")
+	}
+	if name == "" {
+		return nil, errors.New("Telegram groups need a name")
+	}
+
+	var users []tg.InputUserClass
+	userLock.RLock()
+	for _, usr := range people {
+		id, _ := strconv.ParseInt(usr.id, 10, 64)
+		if input, ok := t.inputUsers[id]; ok && id != t.context.Self.ID {
+			users = append(users, input)
+		}
+	}
+	userLock.RUnlock()
+	invited, err := t.context.Raw.MessagesCreateChat(t.context, &tg.MessagesCreateChatRequest{Users: users,
+		Title: name})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range updatedChats(invited.Updates) {
+		if ch := t.addChat(c); ch != nil {
+			return ch, nil
+		}
+	}
+	return nil, errors.New("Telegram did not return the new group")
+}
+
+// leave removes us from a group, supergroup or channel.
+func (t *telegram) leave(ch *channel) error {
+	if t.proto == nil {
+		return errors.New("not connected")
+	}
+	if ch.direct {
+		return errors.New("direct messages cannot be left")
+	}
+
+	var err error
+	if input := t.inputChannel(ch); input != nil {
+		_, err = t.context.Raw.ChannelsLeaveChannel(t.context, input)
+	} else {
+		id, _ := strconv.Atoi(ch.id)
+		_, err = t.context.Raw.MessagesDeleteChatUser(t.context, &tg.MessagesDeleteChatUserRequest{
+			ChatID: int64(id), UserID: &tg.InputUserSelf{}})
+	}
+	if err != nil {
+		return err
+	}
+	t.ui.removeChannel(ch)
+	return nil
+}
+
+// leaveServer refuses, the server of a Telegram login is the account itself rather than something joined.
+func (t *telegram) leaveServer(*server) error {
+	return errors.New("Telegram accounts cannot be left, leave their groups and channels instead")
+}
+
+// updatedChats returns the chats sent with an update, such as after joining or creating a group.
+func updatedChats(up tg.UpdatesClass) []tg.ChatClass {
+	switch u := up.(type) {
+	case *tg.Updates:
+		return u.Chats
+	case *tg.UpdatesCombined:
+		return u.Chats
+	}
+	return nil
+}
+
+// loadFirstChannel loads the messages for the channel shown when our server is selected.
+func (t *telegram) loadFirstChannel(s *ext.Context, ch *channel, u *ui) {
+	ch.loaded = true
+	added := ch.appendNew(t.loadMessages(s, ch))
+	if ch.server == u.currentServer {
+		u.setChannel(ch)
 	} else {
-		nid = &tg.InputPeerChat{ChatID: id}
+		u.messagesAdded(ch, added)
+	}
+}
+
+// history loads the recent messages of a chat that was not loaded when we connected.
+func (t *telegram) history(ch *channel) ([]*message, error) {
+	if t.proto == nil {
+		return nil, errors.New("not connected")
+	}
+	return t.loadMessages(t.context, ch), nil
+}
+
+func (t *telegram) loadMessages(s *ext.Context, ch *channel) []*message {
+	req := &tg.MessagesGetHistoryRequest{Peer: t.peer(ch)}
+	ret, err := s.Raw.MessagesGetHistory(s, req)
+	if wait, ok := tgerr.AsFloodWait(err); ok { // asked too often, Telegram tells us how long to wait
+		log.Println("Waiting", wait, "to load messages of", ch.name)
+		time.Sleep(wait)
+		ret, err = s.Raw.MessagesGetHistory(s, req)
 	}
-	ret, err := s.Raw.MessagesGetHistory(s, &tg.MessagesGetHistoryRequest{Peer: nid})
-	//	ret, err := s.MessagesGetHistory(nid, 0, 0, 0, 15, 6500000, 0)
 	if err != nil {
 		fyne.LogError("Unknown message download error", err)
 		return nil
 	}
+	history, ok := ret.AsModified()
+	if !ok {
+		return nil
+	}
 
+	id, _ := strconv.ParseInt(ch.id, 10, 64)
 	var list []*message
-	ms := ret.(*tg.MessagesMessagesSlice).Messages
+	ms := history.GetMessages()
 	for i := len(ms) - 1; i >= 0; i-- { // newest message is first in response
 		data, ok := ms[i].AsNotEmpty()
 		if !ok {
@@ -203,39 +933,511 @@ func (t *telegram) loadMessages(s *ext.Context, id int64, direct bool) []*messag
 			continue
 		}
 
-		m := data.(*tg.Message)
-		from := id
-		if m.FromID != nil {
-			from = m.FromID.(*tg.PeerUser).UserID
+		if svc, ok := data.(*tg.MessageService); ok {
+			if msg := t.serviceMessage(svc, id); msg != nil {
+				list = append(list, msg)
+			}
+			continue
 		}
-		msg := &message{content: m.Message, user: t.getUser(from)}
-		list = append(list, msg)
+		list = append(list, t.newMessage(data.(*tg.Message), id))
 	}
 
 	return list
 }
 
-func (t *telegram) send(ch *channel, text string) {
+// newMessage converts a message in the chat with id, those without an author are from the chat itself.
+func (t *telegram) newMessage(m *tg.Message, id int64) *message {
+	from := id
+	if m.FromID != nil {
+		from = peerID(m.FromID)
+	} else if m.Out {
+		from = t.context.Self.ID
+	}
+	rich := telegramRich(m.Message, m.Entities)
+	if media, ok := t.mediaSpan(m.PeerID, m); ok {
+		if len(rich) > 0 {
+			rich = append(rich, richSpan{text: "\n"})
+		}
+		rich = append(rich, media)
+	}
+	return &message{id: strconv.Itoa(m.ID), content: m.Message, rich: rich,
+		sent: time.Unix(int64(m.Date), 0), user: t.getUser(from), mentioned: m.Mentioned, pinned: m.Pinned}
+}
+
+// pinned searches ch for the messages pinned in it, newest first.
+func (t *telegram) pinned(ch *channel) ([]*message, error) {
+	if t.proto == nil {
+		return nil, errors.New("not connected")
+	}
+
 	id, _ := strconv.Atoi(ch.id)
-	send := msg2.NewSender(t.proto.API())
-	var builder *msg2.RequestBuilder
+	ret, err := t.context.Raw.MessagesSearch(t.context, &tg.MessagesSearchRequest{
+		Peer: t.peer(ch), Filter: &tg.InputMessagesFilterPinned{}, Limit: searchLimit})
+	if err != nil {
+		return nil, err
+	}
+	found, ok := ret.AsModified()
+	if !ok {
+		return nil, nil
+	}
 
-	if ch.direct {
-		builder = send.To(&tg.InputPeerUser{UserID: int64(id)})
-	} else {
-		builder = send.To(&tg.InputPeerChat{ChatID: int64(id)})
+	var list []*message
+	for _, data := range found.GetMessages() {
+		if m, ok := data.(*tg.Message); ok {
+			list = append(list, t.newMessage(m, int64(id)))
+		}
+	}
+	return list, nil
+}
+
+// setPinned pins or unpins m in its chat.
+func (t *telegram) setPinned(m *message, on bool) error {
+	if t.proto == nil {
+		return errors.New("not connected")
+	}
+
+	id, _ := strconv.Atoi(m.id)
+	_, err := t.context.Raw.MessagesUpdatePinnedMessage(t.context, &tg.MessagesUpdatePinnedMessageRequest{
+		Peer: t.peer(m.channel), ID: id, Unpin: !on})
+	return err
+}
+
+// serviceMessage returns a system message for an event in the chat with id, such as someone joining or a call,
+// or nil if it is not one we show.
+func (t *telegram) serviceMessage(m *tg.MessageService, id int64) *message {
+	from := id
+	if p, ok := m.FromID.(*tg.PeerUser); ok {
+		from = p.UserID
 	}
 
-	_, err := builder.Text(context.Background(), text)
+	var text string
+	switch a := m.Action.(type) {
+	case *tg.MessageActionPhoneCall:
+		_, missed := a.Reason.(*tg.PhoneCallDiscardReasonMissed)
+		_, busy := a.Reason.(*tg.PhoneCallDiscardReasonBusy)
+		text = callText(a.Video, m.Out, missed || busy, time.Duration(a.Duration)*time.Second)
+	case *tg.MessageActionChatCreate:
+		text = "created the group " + a.Title
+	case *tg.MessageActionChatAddUser:
+		if len(a.Users) == 1 && a.Users[0] == from {
+			text = "joined"
+		} else {
+			text = "added " + t.userNames(a.Users)
+		}
+	case *tg.MessageActionChatDeleteUser:
+		if a.UserID == from {
+			text = "left"
+		} else {
+			text = "removed " + t.userNames([]int64{a.UserID})
+		}
+	case *tg.MessageActionChatJoinedByLink:
+		text = "joined using an invite link"
+	case *tg.MessageActionChatJoinedByRequest:
+		text = "joined"
+	case *tg.MessageActionChatEditTitle:
+		text = "renamed the group to " + a.Title
+	case *tg.MessageActionChatEditPhoto:
+		text = "changed the group photo"
+	case *tg.MessageActionChatDeletePhoto:
+		text = "removed the group photo"
+	case *tg.MessageActionPinMessage:
+		text = "pinned a message"
+	default:
+		return nil
+	}
+
+	return &message{id: strconv.Itoa(m.ID), content: text, sent: time.Unix(int64(m.Date), 0), user: t.getUser(from),
+		system: true}
+}
+
+// userNames lists the names of the users with ids, for system messages.
+func (t *telegram) userNames(ids []int64) string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = t.getUser(id).displayName()
+	}
+	return strings.Join(names, ", ")
+}
+
+// incomingCall adds a system message to the conversation with whoever is calling us.
+func (t *telegram) incomingCall(call *tg.PhoneCallRequested) {
+	caller := t.getUser(call.AdminID)
+	ch, err := t.directChannel(caller)
 	if err != nil {
-		fyne.LogError("Failed to send message", err)
+		log.Println("Could not find conversation for call", err)
 		return
 	}
 
-	msg := &message{content: text, user: t.getUser(t.context.Self.ID)}
-	ch.messages = append(ch.messages, msg)
-	t.ui.messages.Objects = nil
-	t.ui.appendMessages(ch.messages)
+	msg := &message{id: "call" + strconv.FormatInt(call.ID, 10), content: callText(call.Video, false, false, 0),
+		sent: time.Unix(int64(call.Date), 0), user: caller, mentioned: true, system: true}
+	t.ui.channels.Refresh()
+	t.ui.messagesAdded(ch, ch.appendNew([]*message{msg}))
+}
+
+// setChannelFlag pins, mutes or archives the dialog on Telegram, hiding is only local.
+func (t *telegram) setChannelFlag(ch *channel, f channelFlag, on bool) error {
+	if t.proto == nil {
+		return errors.New("not connected")
+	}
+
+	peer := t.peer(ch)
+	var err error
+	switch f {
+	case flagPinned:
+		_, err = t.context.Raw.MessagesToggleDialogPin(t.context, &tg.MessagesToggleDialogPinRequest{Pinned: on,
+			Peer: &tg.InputDialogPeer{Peer: peer}})
+	case flagArchived:
+		folder := 0
+		if on {
+			folder = telegramArchiveFolder
+		}
+		_, err = t.context.Raw.FoldersEditPeerFolders(t.context, []tg.InputFolderPeer{{Peer: peer, FolderID: folder}})
+	case flagMuted:
+		settings := tg.InputPeerNotifySettings{}
+		if on {
+			settings.SetMuteUntil(math.MaxInt32)
+		} else {
+			settings.SetMuteUntil(0)
+		}
+		_, err = t.context.Raw.AccountUpdateNotifySettings(t.context, &tg.AccountUpdateNotifySettingsRequest{
+			Peer: &tg.InputNotifyPeer{Peer: peer}, Settings: settings})
+	}
+	return err
+}
+
+// applyDialogSettings copies whether each dialog is pinned, muted or archived on Telegram to our channels of srv.
+func applyDialogSettings(srv *server, dialogs []tg.DialogClass) {
+	for _, d := range dialogs {
+		dialog, ok := d.(*tg.Dialog)
+		if !ok {
+			continue
+		}
+
+		key := channelKey(srv.id, strconv.FormatInt(peerID(dialog.Peer), 10), isUserPeer(dialog.Peer))
+		setKeyFlag(srv.login, key, flagPinned, dialog.Pinned)
+		setKeyFlag(srv.login, key, flagArchived, dialog.FolderID == telegramArchiveFolder)
+		until, _ := dialog.NotifySettings.GetMuteUntil()
+		setKeyFlag(srv.login, key, flagMuted, int64(until) > time.Now().Unix())
+	}
+}
+
+func (t *telegram) send(ch *channel, rich []richSpan) error {
+	if t.proto == nil {
+		return errors.New("not connected")
+	}
+
+	send := msg2.NewSender(t.proto.API())
+	up, err := send.To(t.peer(ch)).StyledText(context.Background(), t.styled(rich)...)
+	if err != nil {
+		return err
+	}
+
+	msg := &message{id: sentMessageID(up), content: plainText(rich), rich: rich, sent: time.Now(),
+		user: t.getUser(t.context.Self.ID)}
+	t.ui.messagesAdded(ch, ch.appendNew([]*message{msg}))
+	return nil
+}
+
+// search asks the server for matching messages, inside a single chat if the query names one or across all chats.
+func (t *telegram) search(q searchQuery) ([]*searchResult, error) {
+	if t.proto == nil {
+		return nil, errors.New("not connected")
+	}
+	if q.text == "" {
+		return nil, nil // the server needs something to look for
+	}
+
+	var inChat *channel
+	if q.channel != "" {
+		for _, c := range t.server.channels {
+			if !containsFold(c.name, q.channel) {
+				continue
+			}
+			if inChat != nil { // more than one chat matches, filter a global search instead
+				inChat = nil
+				break
+			}
+			inChat = c
+		}
+	}
+
+	var ret tg.MessagesMessagesClass
+	var err error
+	if inChat != nil {
+		ret, err = t.context.Raw.MessagesSearch(t.context, &tg.MessagesSearchRequest{
+			Peer: t.peer(inChat), Q: q.text, Filter: &tg.InputMessagesFilterEmpty{},
+			MinDate: searchDate(q.from), MaxDate: searchDate(q.to), Limit: searchLimit})
+	} else {
+		ret, err = t.context.Raw.MessagesSearchGlobal(t.context, &tg.MessagesSearchGlobalRequest{
+			Q: q.text, Filter: &tg.InputMessagesFilterEmpty{}, OffsetPeer: &tg.InputPeerEmpty{},
+			MinDate: searchDate(q.from), MaxDate: searchDate(q.to), Limit: searchLimit})
+	}
+	if err != nil {
+		return nil, err
+	}
+	found, ok := ret.AsModified()
+	if !ok {
+		return nil, nil
+	}
+
+	var results []*searchResult
+	for _, data := range found.GetMessages() {
+		m, ok := data.(*tg.Message)
+		if !ok {
+			continue
+		}
+
+		chID, direct := strconv.Itoa(int(peerID(m.PeerID))), isUserPeer(m.PeerID)
+		name := chID
+		if ch := findKey(t.server, channelKey(t.server.id, chID, direct)); ch != nil {
+			name = ch.name
+		}
+		from := peerID(m.PeerID)
+		if m.FromID != nil {
+			from = peerID(m.FromID)
+		}
+		author := ""
+		if usr := t.getUser(from); usr != nil {
+			author = usr.name
+		}
+
+		r := &searchResult{login: t.server.login, server: t.server.id, channel: chID, msgID: strconv.Itoa(m.ID),
+			channelName: name, author: author, snippet: m.Message, content: m.Message,
+			sent: time.Unix(int64(m.Date), 0), direct: direct, remote: true}
+		if q.matches(r) {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// resync loads the recent messages for each channel, adding any that arrived while we were offline.
+func (t *telegram) resync(s *ext.Context, u *ui) {
+	for _, c := range t.server.channels {
+		if !c.loaded {
+			continue // it will be loaded when opened
+		}
+		u.messagesAdded(c, c.appendNew(t.loadMessages(s, c)))
+	}
+}
+
+// run wraps the client main loop so we can reconnect if it stops unexpectedly.
+func (t *telegram) run(run func(context.Context, func(context.Context) error) error,
+	ctx context.Context, f func(context.Context) error) error {
+	err := run(ctx, f)
+	if err != nil && ctx.Err() == nil && t.status.currentState() == stateOnline {
+		fyne.LogError("Telegram connection lost", err)
+		t.status.dropped()
+	}
+	return err
+}
+
+// watch checks that the connection is still alive.
+// The client redials dropped connections by itself so we track the state and catch up when it returns.
+func (t *telegram) watch(client *gotgproto.Client, s *ext.Context) {
+	for {
+		select {
+		case <-s.Done():
+			return
+		case <-time.After(telegramPingInterval):
+		}
+
+		ping, cancel := context.WithTimeout(s, telegramPingTimeout)
+		_, err := client.API().UpdatesGetState(ping)
+		cancel()
+		if s.Err() != nil || t.proto != client {
+			return
+		}
+
+		state := t.status.currentState()
+		if err != nil {
+			if state == stateOnline {
+				fyne.LogError("Telegram connection is not responding", err)
+				t.status.setState(stateReconnecting)
+			}
+		} else if state == stateReconnecting {
+			t.status.setState(stateOnline)
+			t.resync(s, t.ui)
+		}
+	}
+}
+
+// telegramRich converts the formatting entities of a message into rich text.
+// Entity offsets count UTF-16 code units, so we split the text in those units.
+// Custom emoji are left as the standard emoji that the text contains in their place.
+func telegramRich(text string, entities []tg.MessageEntityClass) []richSpan {
+	units := utf16.Encode([]rune(text))
+	cuts := []int{0, len(units)}
+	for _, e := range entities {
+		cuts = append(cuts, e.GetOffset(), e.GetOffset()+e.GetLength())
+	}
+	sort.Ints(cuts)
+
+	var spans []richSpan
+	for i := 0; i+1 < len(cuts); i++ {
+		from, to := cuts[i], cuts[i+1]
+		if from == to || from < 0 || to > len(units) {
+			continue
+		}
+
+		span := richSpan{text: string(utf16.Decode(units[from:to]))}
+		for _, e := range entities {
+			start, end := e.GetOffset(), e.GetOffset()+e.GetLength()
+			if start > from || end < to || end > len(units) {
+				continue
+			}
+
+			switch ent := e.(type) {
+			case *tg.MessageEntityBold:
+				span.style |= richBold
+			case *tg.MessageEntityItalic:
+				span.style |= richItalic
+			case *tg.MessageEntityUnderline:
+				span.style |= richUnderline
+			case *tg.MessageEntityStrike:
+				span.style |= richStrike
+			case *tg.MessageEntitySpoiler:
+				span.style |= richSpoiler
+			case *tg.MessageEntityCode:
+				span.style |= richCode
+			case *tg.MessageEntityPre:
+				span.style |= richCodeBlock
+			case *tg.MessageEntityURL:
+				span.link = string(utf16.Decode(units[start:end]))
+			case *tg.MessageEntityTextURL:
+				span.link = ent.URL
+			case *tg.MessageEntityEmail:
+				span.link = "mailto:" + string(utf16.Decode(units[start:end]))
+			case *tg.MessageEntityMention, *tg.MessageEntityMentionName:
+				span.mention = true
+			}
+		}
+		spans = append(spans, span)
+	}
+	if len(entities) == 0 {
+		return linkURLs(spans)
+	}
+	return spans
+}
+
+var telegramFormats = []struct {
+	style  richStyle
+	format func() entity.Formatter
+}{{richBold, entity.Bold}, {richItalic, entity.Italic}, {richUnderline, entity.Underline},
+	{richStrike, entity.Strike}, {richSpoiler, entity.Spoiler}, {richCode, entity.Code}}
+
+// styled converts rich text into the message entities that Telegram uses for formatting.
+// Mentions of users we know how to address notify them, even if they have no username.
+func (t *telegram) styled(rich []richSpan) []styling.StyledTextOption {
+	var texts []styling.StyledTextOption
+	for _, s := range rich {
+		span := s
+		texts = append(texts, styling.Custom(func(b *entity.Builder) error {
+			var formats []entity.Formatter
+			for _, f := range telegramFormats {
+				if span.style&f.style != 0 {
+					formats = append(formats, f.format())
+				}
+			}
+			if span.style&richCodeBlock != 0 {
+				formats = append(formats, entity.Pre(""))
+			}
+			if span.link != "" {
+				formats = append(formats, entity.TextURL(span.link))
+			}
+			text := span.text
+			if span.emojiID != "" {
+				for _, e := range t.server.emojis {
+					if e.id == span.emojiID {
+						id, _ := strconv.ParseInt(e.id, 10, 64)
+						text = e.alt // the entity covers the standard emoji it replaces
+						formats = append(formats, entity.CustomEmoji(id))
+					}
+				}
+			}
+			if span.userID != "" {
+				id, _ := strconv.ParseInt(span.userID, 10, 64)
+				userLock.RLock()
+				input, ok := t.inputUsers[id]
+				userLock.RUnlock()
+				if ok {
+					formats = append(formats, entity.MentionName(input))
+				}
+			}
+
+			b.Format(text, formats...)
+			return nil
+		}))
+	}
+	return texts
+}
+
+// inputPeer returns the peer to address a chat or direct message with the given id.
+func inputPeer(id int64, direct bool) tg.InputPeerClass {
+	if direct {
+		return &tg.InputPeerUser{UserID: id}
+	}
+	return &tg.InputPeerChat{ChatID: id}
+}
+
+// isUserPeer returns true if p is a direct conversation with a user.
+func isUserPeer(p tg.PeerClass) bool {
+	_, ok := p.(*tg.PeerUser)
+	return ok
+}
+
+// inputPeerID returns the user, chat or channel id that an input peer refers to, and true if it is a user.
+func inputPeerID(p tg.InputPeerClass) (int64, bool) {
+	switch peer := p.(type) {
+	case *tg.InputPeerUser:
+		return peer.UserID, true
+	case *tg.InputPeerChat:
+		return peer.ChatID, false
+	case *tg.InputPeerChannel:
+		return peer.ChannelID, false
+	}
+	return 0, false
+}
+
+// peerID returns the user, chat or channel id that a peer refers to.
+func peerID(p tg.PeerClass) int64 {
+	switch peer := p.(type) {
+	case *tg.PeerUser:
+		return peer.UserID
+	case *tg.PeerChat:
+		return peer.ChatID
+	case *tg.PeerChannel:
+		return peer.ChannelID
+	}
+	return 0
+}
+
+// searchDate converts a search time to the server format, where zero means no limit.
+func searchDate(t time.Time) int {
+	if t.IsZero() {
+		return 0
+	}
+	return int(t.Unix())
+}
+
+// sentMessageID finds the id that the server gave to a message we just sent.
+func sentMessageID(up tg.UpdatesClass) string {
+	switch u := up.(type) {
+	case *tg.UpdateShortSentMessage:
+		return strconv.Itoa(u.ID)
+	case *tg.Updates:
+		for _, inner := range u.Updates {
+			if id, ok := inner.(*tg.UpdateMessageID); ok {
+				return strconv.Itoa(id.ID)
+			}
+		}
+	}
+	return ""
+}
+
+// telegramSessionFile returns the name of the session storage for the login at prefix.
+func telegramSessionFile(prefix string) string {
+	return "fybro-telegram-" + strings.Trim(prefix, ".") + ".sqlite"
 }
 
 func userDisplayName(u *tg.User) string {
@@ -261,15 +1463,20 @@ func (i *inputGetter) AskCode() (string, error) {
 	wg := sync.WaitGroup{}
 
 	conf := widget.NewEntry()
+	confirmed := false
 	dialog.ShowForm("Telegram code for "+i.num, "Log in", "cancel",
 		[]*widget.FormItem{
 			{Text: "Auth Code", Widget: conf},
 		}, func(ok bool) {
+			confirmed = ok
 			wg.Done()
 		}, w)
 	wg.Add(1)
 
 	wg.Wait()
+	if !confirmed {
+		return "", errAuthRequired
+	}
 	return conf.Text, nil
 }
 
@@ -278,15 +1485,20 @@ func (i *inputGetter) AskPassword() (string, error) {
 	wg := sync.WaitGroup{}
 
 	conf := widget.NewPasswordEntry()
+	confirmed := false
 	dialog.ShowForm("Telegram password for "+i.num, "Log in", "cancel",
 		[]*widget.FormItem{
 			{Text: "Password", Widget: conf},
 		}, func(ok bool) {
+			confirmed = ok
 			wg.Done()
 		}, w)
 	wg.Add(1)
 
 	wg.Wait()
+	if !confirmed {
+		return "", errAuthRequired
+	}
 	return conf.Text, nil
 }
 
@@ -298,37 +1510,111 @@ type updateHandler struct {
 	u *ui
 }
 
-func (u *updateHandler) CheckUpdate(_ *ext.Context, up *ext.Update) error {
-	switch t := up.UpdateClass.(type) {
-	case *tg.UpdateNewMessage:
-		m := up.EffectiveMessage
-		from := int64(0)
-		if m.FromID != nil {
-			from = m.FromID.(*tg.PeerUser).UserID
-		} else {
-			log.Println("unknown from")
-		}
-		msg := &message{content: m.Message.Message, user: u.t.getUser(from)}
+// messageArrived adds a new message to its chat, listing the chat if it is new to us.
+func (u *updateHandler) messageArrived(up *ext.Update, data tg.MessageClass) {
+	var peer tg.PeerClass
+	switch m := data.(type) {
+	case *tg.Message:
+		peer = m.PeerID
+	case *tg.MessageService:
+		peer = m.PeerID
+	default:
+		return
+	}
 
-		cid := int64(0)
-		if u, ok := m.PeerID.(*tg.PeerUser); ok {
-			cid = u.UserID
-		} else if c, ok := m.PeerID.(*tg.PeerChat); ok {
-			cid = c.ChatID
-		} else {
-			log.Println("Unknown type", m.PeerID)
+	id := peerID(peer)
+	ch := u.t.peerChannel(peer)
+	if ch == nil && up.Entities != nil { // a chat that started since we loaded the list
+		if usr, ok := up.Entities.Users[id]; ok && isUserPeer(peer) {
+			ch = u.t.addDirect(usr)
+		} else if chat, ok := up.Entities.Chats[id]; ok {
+			ch = u.t.addChat(chat)
+		} else if channel, ok := up.Entities.Channels[id]; ok {
+			ch = u.t.addChat(channel)
 		}
+		if ch != nil {
+			u.u.channels.Refresh()
+		}
+	}
+	if ch == nil {
+		log.Println("Could not find channel for incoming message")
+		return
+	}
 
-		ch := findServerChan(u.t.server, strconv.Itoa(int(cid)))
-		ch.messages = append(ch.messages, msg)
+	svc, ok := data.(*tg.MessageService)
+	if !ok {
+		u.u.messagesAdded(ch, ch.appendNew([]*message{u.t.newMessage(data.(*tg.Message), id)}))
+		return
+	}
+	if left, ok := svc.Action.(*tg.MessageActionChatDeleteUser); ok && left.UserID == u.t.context.Self.ID {
+		u.u.removeChannel(ch)
+		return
+	}
+	if msg := u.t.serviceMessage(svc, id); msg != nil {
+		u.u.messagesAdded(ch, ch.appendNew([]*message{msg}))
+	}
+	if title, ok := svc.Action.(*tg.MessageActionChatEditTitle); ok {
+		ch.name = title.Title
+		u.u.channels.Refresh()
+	}
+}
 
-		if ch == u.u.currentChannel {
-			u.u.messages.Objects = nil
-			u.u.appendMessages(u.u.currentChannel.messages)
+// channelChanged lists a supergroup or channel we joined from another device, or removes one we left.
+func (u *updateHandler) channelChanged(up *ext.Update, id int64) {
+	ch := u.t.groupChannel(strconv.FormatInt(id, 10))
+	var info *tg.Channel
+	if up.Entities != nil {
+		info = up.Entities.Channels[id]
+	}
+	switch {
+	case info == nil:
+		return
+	case ch != nil && info.Left:
+		u.u.removeChannel(ch)
+	case ch == nil && !info.Left:
+		if ch = u.t.addChat(info); ch != nil {
+			ch.appendNew(u.t.loadMessages(u.t.context, ch))
+			u.u.channels.Refresh()
 		}
+	}
+}
+
+func (u *updateHandler) CheckUpdate(_ *ext.Context, up *ext.Update) error {
+	switch t := up.UpdateClass.(type) {
+	case *tg.UpdateNewMessage:
+		u.messageArrived(up, t.Message)
+	case *tg.UpdateNewChannelMessage:
+		u.messageArrived(up, t.Message)
+	case *tg.UpdateChannel:
+		u.channelChanged(up, t.ChannelID)
+	case *tg.UpdateFolderPeers:
+		for _, p := range t.FolderPeers {
+			key := channelKey(u.t.server.id, strconv.FormatInt(peerID(p.Peer), 10), isUserPeer(p.Peer))
+			setKeyFlag(u.t.server.login, key, flagArchived, p.FolderID == telegramArchiveFolder)
+		}
+		u.t.applyFolders()
+	case *tg.UpdateDialogFilter, *tg.UpdateDialogFilters, *tg.UpdateDialogFilterOrder:
+		go func() {
+			u.t.loadFolders(u.t.context)
+			u.t.applyFolders()
+		}()
 	case *tg.UpdateEditMessage:
 		log.Println("TODO handle edited message")
-	case *tg.UpdateUserStatus, *tg.UpdateUserTyping, *tg.UpdateReadHistoryInbox, *tg.UpdateReadHistoryOutbox:
+	case *tg.UpdatePhoneCall:
+		if call, ok := t.PhoneCall.(*tg.PhoneCallRequested); ok && call.AdminID != u.t.context.Self.ID {
+			u.t.incomingCall(call)
+		}
+	case *tg.UpdateUserStatus:
+		userLock.Lock()
+		usr, ok := u.t.server.users[strconv.Itoa(int(t.UserID))]
+		if ok {
+			usr.presence = telegramPresence(t.Status)
+		}
+		userLock.Unlock()
+		if ok {
+			u.u.presenceChanged()
+		}
+	case *tg.UpdateUserTyping, *tg.UpdateReadHistoryInbox, *tg.UpdateReadHistoryOutbox:
 		log.Println("ignoring typing/read status")
 	default:
 		log.Println("Unknown update", t)
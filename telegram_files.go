@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/storage/repository"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+const (
+	telegramFileScheme = "telegram"
+	telegramFileChunk  = 512 * 1024 // upload.getFile wants a multiple of 4KiB that divides 1MiB
+)
+
+var (
+	telegramAccounts     = map[string]*telegram{} // the logins that files are downloaded through, by Telegram user id
+	telegramAccountsLock sync.RWMutex
+	telegramFilesOnce    sync.Once
+)
+
+// addTelegramFiles lets the avatars and media seen by the account t is logged in to load from telegram:// URIs.
+func addTelegramFiles(t *telegram) {
+	telegramFilesOnce.Do(func() {
+		repository.Register(telegramFileScheme, &telegramFiles{})
+	})
+	telegramAccountsLock.Lock()
+	telegramAccounts[strconv.FormatInt(t.context.Self.ID, 10)] = t
+	telegramAccountsLock.Unlock()
+}
+
+// avatarURI returns where the profile photo of a user or chat is loaded from, or "" if it has none.
+// Photos of peers are addressed by the peer, so they have no file reference to expire.
+func (t *telegram) avatarURI(kind string, id, photo int64) string {
+	if photo == 0 || t.context == nil {
+		return ""
+	}
+	return telegramFileScheme + "://" + strconv.FormatInt(t.context.Self.ID, 10) + "/photo/" + kind + "/" +
+		strconv.FormatInt(id, 10) + "/" + strconv.FormatInt(photo, 10) + ".jpg"
+}
+
+// mediaSpan returns a link to the photo or document attached to m in the chat with peer, or false if it has none.
+// The file is downloaded when the link is tapped.
+func (t *telegram) mediaSpan(peer tg.PeerClass, m *tg.Message) (richSpan, bool) {
+	label, ext := "", ""
+	switch media := m.Media.(type) {
+	case *tg.MessageMediaPhoto:
+		if _, ok := media.Photo.(*tg.Photo); ok {
+			label, ext = "📷 Photo", ".jpg"
+		}
+	case *tg.MessageMediaDocument:
+		if doc, ok := media.Document.(*tg.Document); ok {
+			label = "📎 File"
+			for _, attr := range doc.Attributes {
+				if name, ok := attr.(*tg.DocumentAttributeFilename); ok {
+					label, ext = "📎 "+name.FileName, path.Ext(name.FileName)
+				}
+			}
+			if ext == "" {
+				if exts, _ := mime.ExtensionsByType(doc.MimeType); len(exts) > 0 {
+					ext = exts[0]
+				}
+			}
+		}
+	}
+	if label == "" || t.context == nil {
+		return richSpan{}, false
+	}
+
+	kind := "chat"
+	if isUserPeer(peer) {
+		kind = "user"
+	}
+	return richSpan{text: label, file: telegramFileScheme + "://" + strconv.FormatInt(t.context.Self.ID, 10) +
+		"/media/" + kind + "/" + strconv.FormatInt(peerID(peer), 10) + "/" + strconv.Itoa(m.ID) +
+		url.PathEscape(ext)}, true
+}
+
+// fileLocation returns where the file at a telegram:// path is stored and, for files with a file reference,
+// how to look the location up again once the reference expires.
+func (t *telegram) fileLocation(path string) (tg.InputFileLocationClass, func() (tg.InputFileLocationClass, error), error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 4 {
+		return nil, nil, errors.New("unknown Telegram file " + path)
+	}
+	ch := &channel{id: parts[2], direct: parts[1] == "user", server: t.server}
+	name, _, _ := strings.Cut(parts[3], ".") // the extension is only there for programs that open the file
+	item, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch parts[0] {
+	case "photo":
+		return &tg.InputPeerPhotoFileLocation{Peer: t.peer(ch), PhotoID: item}, nil, nil
+	case "media":
+		refresh := func() (tg.InputFileLocationClass, error) {
+			m, err := t.fetchMessage(ch, int(item))
+			if err != nil {
+				return nil, err
+			}
+			return mediaLocation(m.Media)
+		}
+		loc, err := refresh()
+		return loc, refresh, err
+	}
+	return nil, nil, errors.New("unknown Telegram file " + path)
+}
+
+// fetchMessage loads the message with id in ch, giving us fresh file references for its media.
+func (t *telegram) fetchMessage(ch *channel, id int) (*tg.Message, error) {
+	ids := []tg.InputMessageClass{&tg.InputMessageID{ID: id}}
+	var ret tg.MessagesMessagesClass
+	var err error
+	if input := t.inputChannel(ch); input != nil {
+		ret, err = t.context.Raw.ChannelsGetMessages(t.context, &tg.ChannelsGetMessagesRequest{Channel: input, ID: ids})
+	} else {
+		ret, err = t.context.Raw.MessagesGetMessages(t.context, ids)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if found, ok := ret.AsModified(); ok {
+		for _, data := range found.GetMessages() {
+			if m, ok := data.(*tg.Message); ok && m.ID == id {
+				return m, nil
+			}
+		}
+	}
+	return nil, errors.New("message " + strconv.Itoa(id) + " was not found in " + ch.name)
+}
+
+// mediaLocation returns where the photo or document of a message is stored, choosing the largest size of photos.
+func mediaLocation(media tg.MessageMediaClass) (tg.InputFileLocationClass, error) {
+	switch media := media.(type) {
+	case *tg.MessageMediaPhoto:
+		if photo, ok := media.Photo.(*tg.Photo); ok {
+			size, width := "", 0
+			for _, s := range photo.Sizes {
+				switch s := s.(type) {
+				case *tg.PhotoSize:
+					if s.W > width {
+						size, width = s.Type, s.W
+					}
+				case *tg.PhotoSizeProgressive:
+					if s.W > width {
+						size, width = s.Type, s.W
+					}
+				}
+			}
+			return &tg.InputPhotoFileLocation{ID: photo.ID, AccessHash: photo.AccessHash,
+				FileReference: photo.FileReference, ThumbSize: size}, nil
+		}
+	case *tg.MessageMediaDocument:
+		if doc, ok := media.Document.(*tg.Document); ok {
+			return &tg.InputDocumentFileLocation{ID: doc.ID, AccessHash: doc.AccessHash,
+				FileReference: doc.FileReference}, nil
+		}
+	}
+	return nil, errors.New("the message has no file")
+}
+
+// download writes the file at loc to w a chunk at a time, so that large documents are not held in memory.
+// If its file reference expires part way through, refresh is asked for a new location and the download carries
+// on where it was.
+func (t *telegram) download(loc tg.InputFileLocationClass, refresh func() (tg.InputFileLocationClass, error),
+	w io.Writer) error {
+	if t.proto == nil {
+		return errors.New("not connected")
+	}
+
+	offset := int64(0)
+	refreshed := false
+	for {
+		ret, err := t.context.Raw.UploadGetFile(t.context, &tg.UploadGetFileRequest{Location: loc,
+			Offset: offset, Limit: telegramFileChunk})
+		if tgerr.Is(err, "FILE_REFERENCE_EXPIRED") && refresh != nil && !refreshed {
+			refreshed = true
+			if loc, err = refresh(); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		file, ok := ret.(*tg.UploadFile)
+		if !ok {
+			return errors.New("the file is only available from a CDN")
+		}
+		if _, err = w.Write(file.Bytes); err != nil {
+			return err
+		}
+		offset += int64(len(file.Bytes))
+		if len(file.Bytes) < telegramFileChunk {
+			return nil
+		}
+	}
+}
+
+// telegramFiles is the storage repository for telegram:// URIs, so that avatars and media load like any other resource.
+type telegramFiles struct{}
+
+func (*telegramFiles) Exists(u fyne.URI) (bool, error) {
+	return telegramAccount(u) != nil, nil
+}
+
+func (*telegramFiles) Reader(u fyne.URI) (fyne.URIReadCloser, error) {
+	t := telegramAccount(u)
+	if t == nil {
+		return nil, errors.New("no Telegram login for " + u.String())
+	}
+
+	loc, refresh, err := t.fileLocation(u.Path())
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "fybro-telegram-*")
+	if err != nil {
+		return nil, err
+	}
+	file := &telegramFile{File: f, uri: u}
+	if err = t.download(loc, refresh, f); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (*telegramFiles) CanRead(u fyne.URI) (bool, error) {
+	return telegramAccount(u) != nil, nil
+}
+
+func (*telegramFiles) Destroy(string) {
+}
+
+// telegramAccount returns the login that can download u, or nil if it is not connected.
+func telegramAccount(u fyne.URI) *telegram {
+	telegramAccountsLock.RLock()
+	defer telegramAccountsLock.RUnlock()
+	return telegramAccounts[u.Authority()]
+}
+
+// telegramFile is a downloaded file being read, kept in a temporary file that is removed when it is closed.
+type telegramFile struct {
+	*os.File
+	uri fyne.URI
+}
+
+func (f *telegramFile) Close() error {
+	err := f.File.Close()
+	_ = os.Remove(f.Name())
+	return err
+}
+
+func (f *telegramFile) URI() fyne.URI {
+	return f.uri
+}
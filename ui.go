@@ -1,109 +1,331 @@
 package main
 
 import (
+	"strings"
+	"sync"
+
 	"fyne.io/fyne/v2"
-	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
+const inboxLimit = 200
+
 type ui struct {
-	servers, channels *widget.List
-	messages          *fyne.Container
-	messageScroll     *container.Scroll
-	create            *widget.Entry
-	win               fyne.Window
+	servers   *widget.List
+	channels  *widget.Tree
+	messages  *messageList
+	create    *composerEntry
+	completer *completer
+	members   *memberPanel
+	win       fyne.Window
 
 	data           *appData
+	inbox          *server // the virtual server that shows direct messages and mentions from every login
+	outbox         *outbox
+	drafts         *drafts
+	search         *searchIndex
 	currentServer  *server
 	currentChannel *channel
+	replyTo        *channel // where messages typed in the inbox are sent, nil for the newest conversation
+
+	loadingMembers map[*channel]bool // guarded by loadingLock, as loads finish in the background
+	loadingLock    sync.Mutex
+	loadingEmojis  map[*server]bool
+	closedSections map[string]bool                       // the channel sections the user opened or closed in each server
+	showHidden     bool                                  // set to list the channels the user has hidden
+	channelRowAt   func(fyne.Position) widget.TreeNodeID // finds the channel tree row under a point, for dropping
+}
+
+// addServers adds the servers of a login to the list, showing the inbox if nothing was selected yet.
+func (u *ui) addServers(list ...*server) {
+	if u.data == nil {
+		u.data = &appData{}
+	}
+	u.data.servers = append(u.data.servers, list...)
+	u.servers.Refresh()
+	if u.currentServer == nil {
+		u.servers.Select(0)
+	}
 }
 
+// appendMessages adds the list to the bottom of the current channel,
+// above any messages that are waiting to send.
 func (u *ui) appendMessages(list []*message) {
-	items := u.messages.Objects
-	for _, m := range list {
-		items = append(items, newMessageCell(m))
+	u.messages.append(list)
+}
+
+// connectionChanged is called when any login changes state, sending queued messages if possible.
+func (u *ui) connectionChanged() {
+	u.servers.Refresh()
+	u.outbox.flush()
+}
+
+// messagesAdded updates the message list if it is showing ch, or the inbox and any of the messages belong there.
+func (u *ui) messagesAdded(ch *channel, added []*message) {
+	if len(added) == 0 {
+		return
+	}
+
+	if ch == u.currentChannel {
+		u.appendMessages(added)
+		return
+	}
+	if !u.showingInbox() {
+		return
+	}
+	for _, m := range added {
+		if m.inInbox() {
+			u.refreshMessages()
+			return
+		}
 	}
-	u.messages.Objects = items
-	u.messages.Refresh()
-	u.messageScroll.ScrollToBottom()
 }
 
 func (u *ui) makeUI(w fyne.Window, a fyne.App) fyne.CanvasObject {
+	u.inbox = &server{name: "All", iconResource: theme.HomeIcon()}
+	u.inbox.channels = []*channel{{id: "inbox", name: "Direct messages & mentions", server: u.inbox}}
 	u.servers = widget.NewList(
 		func() int {
 			if u.data == nil {
-				return 1
+				return 2
 			}
-			return len(u.data.servers) + 1
+			return len(u.data.servers) + 2
 		},
 		func() fyne.CanvasObject {
-			img := &canvas.Image{}
-			img.SetMinSize(fyne.NewSize(theme.IconInlineSize()*2, theme.IconInlineSize()*2))
-			return img
+			return newServerCell()
 		},
 		func(id widget.ListItemID, o fyne.CanvasObject) {
-			if u.data == nil || id == len(u.data.servers) {
-				o.(*canvas.Image).Resource = theme.ContentAddIcon()
-			} else {
-				o.(*canvas.Image).Resource = u.data.servers[id].icon()
-			}
-			o.Refresh()
+			srv := u.serverAt(id)
+			o.(*serverCell).setServer(srv, srv != nil && u.data.sharesService(srv))
 		})
 	u.servers.OnSelected = func(id widget.ListItemID) {
-		if u.data == nil || id == len(u.data.servers) {
+		srv := u.serverAt(id)
+		if srv == nil {
 			u.servers.Unselect(id)
 			u.addLogin(w, a)
 			return
 		}
-		u.currentServer = u.data.servers[id]
-		u.channels.Unselect(0)
-		u.channels.Select(0)
+		u.currentServer = srv
+		u.showServerChannels()
+		u.showStatus(u.currentServer)
 	}
 
-	u.channels = widget.NewList(
-		func() int {
-			if u.currentServer == nil {
-				return 0
-			}
-			return len(u.currentServer.channels)
-		},
-		func() fyne.CanvasObject {
-			return widget.NewLabel("")
-		},
-		func(id widget.ListItemID, o fyne.CanvasObject) {
-			o.(*widget.Label).SetText(u.currentServer.channels[id].name)
-		})
-	u.channels.OnSelected = func(id widget.ListItemID) {
-		u.setChannel(u.currentServer.channels[id])
-	}
+	u.closedSections = make(map[string]bool)
+	u.channels = u.makeChannelTree()
 
-	u.messages = container.NewVBox()
-	u.messageScroll = container.NewScroll(u.messages)
+	u.outbox = newOutbox(u, a)
+	u.drafts = newDrafts(a)
+	u.loadingMembers = make(map[*channel]bool)
+	u.loadingEmojis = make(map[*server]bool)
+	u.search = newSearchIndex(a)
+	u.messages = newMessageList()
+	u.messages.onChannel = u.openChannel
+	u.messages.onFile = u.openFile
+	u.messages.onUser = func(m *message, pos fyne.Position) {
+		if m.channel != nil {
+			u.showProfile(m.user, m.channel.server, nil, pos)
+		}
+	}
+	u.messages.onMenu = u.showMessageMenu
+	u.members = newMemberPanel(u.memberTapped)
 
-	u.create = widget.NewEntry()
-	u.create.OnSubmitted = u.send
-	messagePane := container.NewBorder(nil,
-		container.NewBorder(nil, nil, nil, widget.NewButtonWithIcon("",
-			theme.MailSendIcon(), func() {
-				u.send(u.create.Text)
-			}), u.create), nil, nil, u.messageScroll)
-	content := container.NewHSplit(u.channels, messagePane)
+	messagePane := container.NewBorder(nil, u.makeComposer(), nil, u.members.content, u.messages.content)
+	content := container.NewHSplit(container.NewBorder(
+		container.NewBorder(nil, nil, nil,
+			container.NewHBox(u.makeAddChannel(), u.makeShowHidden()), u.makeSearchEntry()), nil, nil, nil, u.channels), messagePane)
 	content.Offset = 0.3
 	return container.NewBorder(nil, nil, u.servers, nil, content)
 }
 
+// refreshMessages rebuilds the message list for the current channel, including those waiting to send.
+// The scroll position is kept, unless the user was at the bottom in which case we stay there.
+func (u *ui) refreshMessages() {
+	if u.currentChannel == nil {
+		return
+	}
+
+	bottom := u.messages.atBottom()
+	u.messages.set(u.currentChannel, u.channelMessages())
+	if bottom {
+		u.messages.scrollToBottom()
+	}
+	u.refreshReplyTo()
+}
+
+// channelMessages returns the messages to show for the current channel, including those waiting to send.
+func (u *ui) channelMessages() []*message {
+	ch := u.currentChannel
+	if !u.showingInbox() {
+		return append(ch.allMessages(), u.outbox.pending(ch)...)
+	}
+
+	var list []*message
+	if u.data != nil {
+		list = u.data.inbox(inboxLimit)
+	}
+	return append(list, u.outbox.all()...)
+}
+
+// refreshOutgoing updates the message list if the outgoing message is in the current channel or the inbox.
+func (u *ui) refreshOutgoing(o *outgoing) {
+	if u.showingInbox() || o.forChannel(u.currentChannel) {
+		u.refreshMessages()
+	}
+}
+
+// refreshReplyTo tells the user where a message typed in the inbox will be sent.
+func (u *ui) refreshReplyTo() {
+	if !u.showingInbox() {
+		u.create.SetPlaceHolder("")
+		return
+	}
+
+	target := u.replyTarget()
+	if target == nil {
+		u.create.SetPlaceHolder("Tap a message to reply")
+		return
+	}
+	u.create.SetPlaceHolder("Reply in " + target.sourceName())
+}
+
+// replyTarget returns the channel that the composer sends to.
+// In the inbox this is the conversation the user tapped, or the one with the newest message.
+func (u *ui) replyTarget() *channel {
+	if !u.showingInbox() {
+		return u.currentChannel
+	}
+	if u.replyTo != nil {
+		return u.replyTo
+	}
+
+	for i := len(u.messages.items) - 1; i >= 0; i-- {
+		msg := u.messages.items[i]
+		if msg.outgoing == nil && msg.channel != nil {
+			return msg.channel
+		}
+	}
+	return nil
+}
+
+// openChannel switches to show ch, selecting its server and channel in the lists.
+func (u *ui) openChannel(ch *channel) {
+	u.selectServer(ch.server)
+	u.selectChannel(ch)
+}
+
+// serverAt returns the server shown at id in the server list, the first is the inbox and nil is the add button.
+func (u *ui) serverAt(id widget.ListItemID) *server {
+	if id == 0 {
+		return u.inbox
+	}
+	if u.data == nil || id > len(u.data.servers) {
+		return nil
+	}
+	return u.data.servers[id-1]
+}
+
+// selectServer selects srv in the server list, which shows its first channel.
+func (u *ui) selectServer(srv *server) {
+	if srv == u.inbox {
+		u.servers.Select(0)
+		return
+	}
+	if u.data == nil {
+		return
+	}
+
+	for i, s := range u.data.servers {
+		if s == srv {
+			u.servers.Select(i + 1)
+			return
+		}
+	}
+}
+
+// send queues the text typed in the composer, or runs it if it is a /command.
+// Starting a message with // sends it with a single leading slash.
 func (u *ui) send(data string) {
-	srv := u.currentServer.service
-	srv.send(u.currentChannel, data)
-	u.create.SetText("")
+	target := u.replyTarget()
+	if strings.HasPrefix(data, "/") && !strings.HasPrefix(data, "//") {
+		if target == nil {
+			target = u.currentChannel
+		}
+		if target != nil {
+			u.runCommand(target, strings.TrimSpace(data))
+			u.create.setDraft("")
+		}
+		return
+	}
+	data = strings.TrimPrefix(data, "/")
+	if data == "" || target == nil {
+		return
+	}
+
+	u.outbox.add(target, u.create.tagged(data))
+	u.create.setDraft("")
+}
+
+// setReplyTo chooses the conversation of m as the place that inbox replies are sent.
+func (u *ui) setReplyTo(m *message) {
+	if m.channel == nil {
+		return
+	}
+
+	u.replyTo = m.channel
+	u.refreshReplyTo()
 }
 
 func (u *ui) setChannel(ch *channel) {
-	u.win.SetTitle(winTitle + ":" + ch.server.name + ":" + ch.name)
+	if old := u.currentChannel; old != nil {
+		old.scroll = u.messages.list.GetScrollOffset()
+		old.scrolledUp = !u.messages.atBottom()
+		if !old.scrolledUp {
+			old.lastRead = u.messages.lastRead()
+		}
+	}
+	u.saveDraft()
+
+	u.replyTo = nil
+	if ch.server == u.inbox {
+		u.win.SetTitle(winTitle + ":" + ch.server.name)
+	} else {
+		srvName := ch.server.name
+		if ch.server.account != "" && u.data.sharesService(ch.server) {
+			srvName += " (" + ch.server.account + ")"
+		}
+		u.win.SetTitle(winTitle + ":" + srvName + ":" + ch.name)
+	}
 
 	u.currentChannel = ch
-	u.messages.Objects = nil
-	u.appendMessages(u.currentChannel.messages)
+	inbox := u.showingInbox()
+	u.messages.showSource = inbox
+	u.messages.onTapped = nil
+	if inbox {
+		u.messages.onTapped = u.setReplyTo
+	}
+	list := u.channelMessages()
+	u.messages.show(ch, list, ch.firstUnread(list), ch.scroll, !ch.scrolledUp)
+	u.refreshReplyTo()
+
+	if inbox {
+		u.members.setChannel(nil)
+	} else {
+		u.members.setChannel(ch)
+		u.loadMembers(ch)
+		u.loadHistory(ch)
+	}
+	u.create.setDraft(u.drafts.get(ch))
+}
+
+// saveDraft keeps the text being typed in the current channel for when the user returns to it.
+func (u *ui) saveDraft() {
+	if u.currentChannel != nil {
+		u.drafts.set(u.currentChannel, u.create.Text)
+	}
+}
+
+func (u *ui) showingInbox() bool {
+	return u.currentChannel != nil && u.currentChannel.server == u.inbox
 }
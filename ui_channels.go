@@ -0,0 +1,304 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const sectionPrefix = "section:" // starts the tree id of a section heading, channels use their key
+
+// makeChannelTree returns the tree of channels in the current server, grouped into collapsible sections.
+// Channels can be dragged to reorder them or in and out of the favourites, and right clicked for more options.
+func (u *ui) makeChannelTree() *widget.Tree {
+	rows := make(map[fyne.CanvasObject]widget.TreeNodeID)
+	t := widget.NewTree(u.channelChildren,
+		func(uid widget.TreeNodeID) bool {
+			return uid == "" || strings.HasPrefix(uid, sectionPrefix)
+		},
+		func(branch bool) fyne.CanvasObject {
+			if branch {
+				return widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+			}
+			return newChannelRow(u)
+		},
+		func(uid widget.TreeNodeID, branch bool, o fyne.CanvasObject) {
+			rows[o] = uid
+			if branch {
+				o.(*widget.Label).SetText(strings.TrimPrefix(uid, sectionPrefix))
+				return
+			}
+			if ch := u.channelNode(uid); ch != nil {
+				o.(*channelRow).setChannel(ch)
+			}
+		})
+	t.OnSelected = func(uid widget.TreeNodeID) {
+		if strings.HasPrefix(uid, sectionPrefix) {
+			t.ToggleBranch(uid)
+			if u.currentChannel != nil {
+				t.Select(u.currentChannel.key())
+			}
+			return
+		}
+		if ch := u.channelNode(uid); ch != nil && ch != u.currentChannel {
+			u.setChannel(ch)
+		}
+	}
+	t.OnBranchOpened = func(uid widget.TreeNodeID) {
+		if u.currentServer != nil && uid != "" {
+			u.closedSections[u.currentServer.login+u.currentServer.id+uid] = false
+		}
+	}
+	t.OnBranchClosed = func(uid widget.TreeNodeID) {
+		if u.currentServer != nil && uid != "" {
+			u.closedSections[u.currentServer.login+u.currentServer.id+uid] = true
+		}
+	}
+
+	u.channelRowAt = func(pos fyne.Position) widget.TreeNodeID {
+		d := fyne.CurrentApp().Driver()
+		for o, uid := range rows {
+			if !o.Visible() {
+				continue
+			}
+			at := d.AbsolutePositionForObject(o)
+			size := o.Size()
+			if pos.X >= at.X && pos.Y >= at.Y && pos.X < at.X+size.Width && pos.Y < at.Y+size.Height {
+				return uid
+			}
+		}
+		return ""
+	}
+	return t
+}
+
+// channelChildren returns the sections and loose channels at the top of the tree, or the channels in a section.
+func (u *ui) channelChildren(uid widget.TreeNodeID) []widget.TreeNodeID {
+	if u.currentServer == nil {
+		return nil
+	}
+
+	var ids []widget.TreeNodeID
+	for _, s := range channelSections(u.currentServer, u.showHidden) {
+		switch {
+		case uid == "" && s.name != "":
+			ids = append(ids, sectionPrefix+s.name)
+		case uid == sectionPrefix+s.name:
+			for _, c := range s.channels {
+				ids = append(ids, c.key())
+			}
+		}
+	}
+	return ids
+}
+
+// channelNode returns the channel of the current server shown at uid, or nil if it is a section heading.
+func (u *ui) channelNode(uid widget.TreeNodeID) *channel {
+	if u.currentServer == nil || strings.HasPrefix(uid, sectionPrefix) {
+		return nil
+	}
+	return findKey(u.currentServer, uid)
+}
+
+// sectionID returns the tree id of the section that ch is shown in, or "" if it is at the top.
+func sectionID(ch *channel) widget.TreeNodeID {
+	if ch.hasFlag(flagArchived) {
+		return sectionPrefix + archivedSection
+	}
+	if ch.isFavourite() {
+		return sectionPrefix + favouritesSection
+	}
+	if ch.category == "" {
+		return ""
+	}
+	return sectionPrefix + ch.category
+}
+
+// showServerChannels refreshes the tree for a newly selected server, opening the sections the user left open.
+// The archived section starts closed.
+func (u *ui) showServerChannels() {
+	u.channels.UnselectAll()
+	for _, id := range u.channelChildren("") {
+		closed, ok := u.closedSections[u.currentServer.login+u.currentServer.id+id]
+		if !ok {
+			closed = id == sectionPrefix+archivedSection
+		}
+		if closed {
+			u.channels.CloseBranch(id)
+		} else {
+			u.channels.OpenBranch(id)
+		}
+	}
+	u.channels.Refresh()
+	u.channels.ScrollToTop()
+
+	for _, s := range channelSections(u.currentServer, u.showHidden) {
+		if len(s.channels) > 0 && s.name != archivedSection {
+			u.channels.Select(s.channels[0].key())
+			return
+		}
+	}
+}
+
+// selectChannel highlights ch in the tree, opening its section if needed, which shows it.
+func (u *ui) selectChannel(ch *channel) {
+	if section := sectionID(ch); section != "" {
+		u.channels.OpenBranch(section)
+	}
+	u.channels.Select(ch.key())
+}
+
+// dropChannel moves ch to where it was dragged, it can be reordered within its section or moved to and from
+// the favourites. Dropping on a section heading puts it at the end of that section.
+func (u *ui) dropChannel(ch *channel, pos fyne.Position) {
+	uid := u.channelRowAt(pos)
+	if uid == "" || uid == ch.key() {
+		return
+	}
+
+	from, to := sectionID(ch), uid
+	target := u.channelNode(uid)
+	if target != nil {
+		to = sectionID(target)
+	}
+	if from != to {
+		switch {
+		case to == sectionPrefix+favouritesSection && !ch.hasFlag(flagArchived):
+			ch.setFavourite(false) // so that it goes to the end
+			ch.setFavourite(true)
+		case from == sectionPrefix+favouritesSection && to == sectionPrefix+ch.category:
+			ch.setFavourite(false)
+		default:
+			return // categories come from the service
+		}
+	}
+	if target != nil {
+		moveChannel(ch, target)
+	}
+	u.channels.Refresh()
+}
+
+// showChannelMenu shows the settings of ch at pos.
+func (u *ui) showChannelMenu(ch *channel, pos fyne.Position) {
+	fav := fyne.NewMenuItem("Add to "+favouritesSection, func() {
+		ch.setFavourite(!ch.isFavourite())
+		u.channels.Refresh()
+	})
+	if ch.isFavourite() {
+		fav.Label = "Remove from " + favouritesSection
+	}
+	flag := func(label string, f channelFlag) *fyne.MenuItem {
+		item := fyne.NewMenuItem(label, func() {
+			u.toggleChannelFlag(ch, f)
+		})
+		item.Checked = ch.hasFlag(f)
+		return item
+	}
+
+	menu := fyne.NewMenu("", fav, flag("Pin to top", flagPinned), flag("Mute", flagMuted),
+		flag("Hide", flagHidden), flag("Archive", flagArchived))
+	if ch.server.leavable {
+		menu.Items = append(menu.Items, fyne.NewMenuItemSeparator(), fyne.NewMenuItem("Leave server "+ch.server.name,
+			func() {
+				u.confirmLeaveServer(ch.server)
+			}))
+	} else if (!ch.direct || ch.group) && ch.server.service != nil {
+		menu.Items = append(menu.Items, fyne.NewMenuItemSeparator(), fyne.NewMenuItem("Leave", func() {
+			u.confirmLeave(ch)
+		}))
+	}
+	widget.ShowPopUpMenuAtPosition(menu, u.win.Canvas(), pos)
+}
+
+// toggleChannelFlag turns a setting of ch on or off, the opposite of how it was, returning whether it is now on.
+// The channel menu and commands such as /mute share it so that they always see the same setting.
+func (u *ui) toggleChannelFlag(ch *channel, f channelFlag) bool {
+	on := !ch.hasFlag(f)
+	u.setChannelFlag(ch, f, on)
+	return on
+}
+
+// setChannelFlag changes a setting of ch and updates the list, telling the service in case it syncs the setting.
+func (u *ui) setChannelFlag(ch *channel, f channelFlag, on bool) {
+	ch.setFlag(f, on)
+	u.channels.Refresh()
+	if f == flagMuted {
+		u.refreshMessages() // the inbox may change
+	}
+	if ch.server.service == nil {
+		return
+	}
+
+	go func() {
+		err := ch.server.service.setChannelFlag(ch, f, on)
+		if err != nil {
+			fyne.LogError("Failed to update "+ch.name+" on "+ch.server.name, err)
+		}
+	}()
+}
+
+// makeShowHidden returns a button that shows or hides the channels the user has hidden.
+func (u *ui) makeShowHidden() fyne.CanvasObject {
+	var b *widget.Button
+	b = widget.NewButtonWithIcon("", theme.VisibilityOffIcon(), func() {
+		u.showHidden = !u.showHidden
+		if u.showHidden {
+			b.SetIcon(theme.VisibilityIcon())
+		} else {
+			b.SetIcon(theme.VisibilityOffIcon())
+		}
+		u.channels.Refresh()
+	})
+	b.Importance = widget.LowImportance
+	return b
+}
+
+// channelRow is a channel in the tree, it can be dragged to reorder and right clicked for a menu.
+type channelRow struct {
+	widget.Label
+	u  *ui
+	ch *channel
+
+	dragTo fyne.Position
+}
+
+func newChannelRow(u *ui) *channelRow {
+	r := &channelRow{u: u}
+	r.ExtendBaseWidget(r)
+	return r
+}
+
+func (r *channelRow) setChannel(ch *channel) {
+	r.ch = ch
+	r.Importance = widget.MediumImportance
+	if ch.hasFlag(flagMuted) {
+		r.Importance = widget.LowImportance
+	}
+	r.TextStyle.Italic = ch.hasFlag(flagHidden)
+	if !ch.voice {
+		r.SetText(ch.name)
+	} else if len(ch.talking) == 0 {
+		r.SetText("🔊 " + ch.name)
+	} else {
+		r.SetText("🔊 " + ch.name + " (" + strconv.Itoa(len(ch.talking)) + ")")
+	}
+}
+
+func (r *channelRow) Dragged(ev *fyne.DragEvent) {
+	r.dragTo = ev.AbsolutePosition
+}
+
+func (r *channelRow) DragEnd() {
+	if r.ch != nil {
+		r.u.dropChannel(r.ch, r.dragTo)
+	}
+}
+
+func (r *channelRow) TappedSecondary(ev *fyne.PointEvent) {
+	if r.ch != nil {
+		r.u.showChannelMenu(r.ch, ev.AbsolutePosition)
+	}
+}
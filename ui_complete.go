@@ -0,0 +1,267 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+const maxCompletions = 8
+
+// completion is a suggestion for the word being typed in the composer.
+type completion struct {
+	label  string // what the list of suggestions shows
+	insert string // the text that replaces the word
+	picked func() // called after the suggestion is inserted, if set
+}
+
+// completer shows suggestions above the composer for the word at the cursor.
+// They are shown in the layout rather than a pop-up so that the entry keeps the keyboard.
+type completer struct {
+	entry   *composerEntry
+	box     *fyne.Container
+	suggest func(word string) []completion
+
+	items     []completion
+	selected  int
+	start     int  // the column where the word being completed begins
+	replacing bool // set while we change the text, so that it is not completed again
+}
+
+func newCompleter(entry *composerEntry, suggest func(word string) []completion) *completer {
+	c := &completer{entry: entry, box: container.NewVBox(), suggest: suggest}
+	c.box.Hide()
+	entry.onKey = c.typedKey
+	return c
+}
+
+// update looks at the word before the cursor and shows the suggestions for it.
+func (c *completer) update() {
+	if c.replacing {
+		return
+	}
+
+	lines := strings.Split(c.entry.Text, "\n")
+	if c.entry.CursorRow >= len(lines) {
+		c.hide()
+		return
+	}
+	line := []rune(lines[c.entry.CursorRow])
+	end := c.entry.CursorColumn
+	if end > len(line) {
+		end = len(line)
+	}
+	start := end
+	for start > 0 && !unicode.IsSpace(line[start-1]) {
+		start--
+	}
+
+	word := string(line[start:end])
+	if word == "" {
+		c.hide()
+		return
+	}
+	c.start = start
+	c.show(c.suggest(word))
+}
+
+func (c *completer) show(items []completion) {
+	if len(items) > maxCompletions {
+		items = items[:maxCompletions]
+	}
+	c.items = items
+	c.selected = 0
+	if len(items) == 0 {
+		c.hide()
+		return
+	}
+
+	c.refresh()
+	c.box.Show()
+}
+
+func (c *completer) hide() {
+	c.items = nil
+	c.box.Hide()
+}
+
+func (c *completer) refresh() {
+	c.box.Objects = nil
+	for i, item := range c.items {
+		i := i
+		b := widget.NewButton(item.label, func() {
+			c.selected = i
+			c.accept()
+		})
+		b.Alignment = widget.ButtonAlignLeading
+		if i == c.selected {
+			b.Importance = widget.HighImportance
+		} else {
+			b.Importance = widget.LowImportance
+		}
+		c.box.Objects = append(c.box.Objects, b)
+	}
+	c.box.Refresh()
+}
+
+// accept replaces the word being typed with the selected suggestion.
+func (c *completer) accept() {
+	item := c.items[c.selected]
+	c.hide()
+
+	c.replacing = true
+	c.entry.replaceWord(c.start, item.insert+" ")
+	c.replacing = false
+	if item.picked != nil {
+		item.picked()
+	}
+	fyne.CurrentApp().Driver().CanvasForObject(c.entry).Focus(c.entry)
+}
+
+// typedKey lets the keyboard choose a suggestion, it returns true if the key was used.
+func (c *completer) typedKey(key *fyne.KeyEvent) bool {
+	if len(c.items) == 0 {
+		return false
+	}
+
+	switch key.Name {
+	case fyne.KeyUp:
+		c.selected = (c.selected + len(c.items) - 1) % len(c.items)
+		c.refresh()
+	case fyne.KeyDown:
+		c.selected = (c.selected + 1) % len(c.items)
+		c.refresh()
+	case fyne.KeyTab, fyne.KeyReturn, fyne.KeyEnter:
+		c.accept()
+	case fyne.KeyEscape:
+		c.hide()
+	default:
+		return false
+	}
+	return true
+}
+
+// suggest returns the completions for a word typed in the composer.
+func (u *ui) suggest(word string) []completion {
+	switch {
+	case strings.HasPrefix(word, "/") && u.completer.start == 0 && u.create.CursorRow == 0:
+		return u.suggestCommands(word[1:])
+	case strings.HasPrefix(word, "@"):
+		return u.suggestMentions(word[1:])
+	case strings.HasPrefix(word, ":") && len(word) > 2 && !strings.HasSuffix(word[1:], ":"):
+		return u.suggestEmoji(word[1:])
+	}
+	return nil
+}
+
+// suggestMentions offers the people in the channel whose name starts with, or else contains, the text typed.
+func (u *ui) suggestMentions(text string) []completion {
+	ch := u.replyTarget()
+	if ch == nil {
+		return nil
+	}
+
+	var starts, contains []*user
+	for _, usr := range u.channelMembers(ch) {
+		name, username := strings.ToLower(usr.displayName()), strings.ToLower(usr.username)
+		query := strings.ToLower(text)
+		if strings.HasPrefix(name, query) || strings.HasPrefix(username, query) {
+			starts = append(starts, usr)
+		} else if strings.Contains(name, query) || strings.Contains(username, query) {
+			contains = append(contains, usr)
+		}
+	}
+
+	var list []completion
+	for _, usr := range append(starts, contains...) {
+		usr := usr
+		label := usr.displayName()
+		if usr.username != "" && usr.username != label {
+			label += " (" + usr.username + ")"
+		}
+		list = append(list, completion{label: label, insert: "@" + usr.displayName(), picked: func() {
+			u.create.tags["@"+usr.displayName()] = mentionToken(usr)
+		}})
+	}
+	return list
+}
+
+// channelMembers returns the people who can be mentioned in ch: its member list once the service has sent it,
+// together with anyone who wrote one of the messages we have. The member list is loaded the first time.
+func (u *ui) channelMembers(ch *channel) []*user {
+	u.loadMembers(ch)
+
+	seen := make(map[*user]bool)
+	var list []*user
+	add := func(usr *user) {
+		if usr == nil || usr.id == "" || seen[usr] {
+			return
+		}
+		seen[usr] = true
+		list = append(list, usr)
+	}
+	for _, m := range ch.memberList() {
+		add(m.user)
+	}
+	msgs := ch.allMessages()
+	for i := len(msgs) - 1; i >= 0; i-- { // the most recent authors are most likely to be wanted
+		add(msgs[i].user)
+	}
+	return list
+}
+
+// loadHistory asks the service for the recent messages of ch the first time it is opened, for services that
+// only load their newest channels when they connect. Older messages are put before any that arrived since.
+func (u *ui) loadHistory(ch *channel) {
+	if ch.loaded || ch.voice || ch.server.service == nil {
+		return
+	}
+
+	ch.loaded = true
+	go func() {
+		list, err := ch.server.service.history(ch)
+		if err != nil {
+			fyne.LogError("Failed to load messages of "+ch.name, err)
+			ch.loaded = false
+			return
+		}
+		if len(ch.addHistory(list)) > 0 && ch == u.currentChannel {
+			u.refreshMessages()
+		}
+	}()
+}
+
+// loadMembers asks the service for the people in ch, if we have not already.
+// The composer suggestions and member list are updated when they arrive.
+func (u *ui) loadMembers(ch *channel) {
+	u.loadingLock.Lock()
+	defer u.loadingLock.Unlock()
+	if ch.memberList() != nil || ch.voice || ch.server.service == nil || u.loadingMembers[ch] {
+		return
+	}
+
+	u.loadingMembers[ch] = true
+	go func() {
+		list, err := ch.server.service.members(ch)
+		if err == nil {
+			sort.SliceStable(list, func(i, j int) bool {
+				return strings.ToLower(list[i].user.displayName()) < strings.ToLower(list[j].user.displayName())
+			})
+			ch.setMembers(append([]*member{}, list...)) // not nil, so that we do not ask again
+		}
+		u.loadingLock.Lock()
+		delete(u.loadingMembers, ch)
+		u.loadingLock.Unlock()
+
+		if err != nil {
+			fyne.LogError("Failed to load members of "+ch.name, err) // left unloaded, so we ask again next time
+			return
+		}
+		u.completer.update()
+		u.members.refresh()
+	}()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	prefComposerSendKey = "composer.send"
+
+	sendOnEnter      = "enter"
+	sendOnShiftEnter = "shift"
+	sendOnCtrlEnter  = "ctrl"
+
+	composerMaxRows = 8
+)
+
+// sendKeyNames describes each send key preference, in the order they are offered.
+var sendKeyNames = []struct{ key, name string }{
+	{sendOnEnter, "Enter sends, Shift+Enter for new line"},
+	{sendOnShiftEnter, "Shift+Enter sends, Enter for new line"},
+	{sendOnCtrlEnter, "Ctrl+Enter sends, Enter for new line"},
+}
+
+var (
+	iconBold   = theme.NewThemedResource(fyne.NewStaticResource("bold.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M15.6 10.79c.97-.67 1.65-1.77 1.65-2.79 0-2.26-1.75-4-4-4H7v14h7.04c2.09 0 3.71-1.7 3.71-3.79 0-1.52-.86-2.82-2.15-3.42zM10 6.5h3c.83 0 1.5.67 1.5 1.5s-.67 1.5-1.5 1.5h-3v-3zm3.5 9H10v-3h3.5c.83 0 1.5.67 1.5 1.5s-.67 1.5-1.5 1.5z"/></svg>`)))
+	iconItalic = theme.NewThemedResource(fyne.NewStaticResource("italic.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M10 4v3h2.21l-3.42 8H6v3h8v-3h-2.21l3.42-8H18V4z"/></svg>`)))
+	iconStrike = theme.NewThemedResource(fyne.NewStaticResource("strike.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M10 19h4v-3h-4v3zM5 4v3h5v3h4V7h5V4H5zM3 14h18v-2H3v2z"/></svg>`)))
+	iconCode   = theme.NewThemedResource(fyne.NewStaticResource("code.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M9.4 16.6L4.8 12l4.6-4.6L8 6l-6 6 6 6 1.4-1.4zm5.2 0l4.6-4.6-4.6-4.6L16 6l6 6-6 6-1.4-1.4z"/></svg>`)))
+	iconEmoji  = theme.NewThemedResource(fyne.NewStaticResource("emoji.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M11.99 2C6.47 2 2 6.48 2 12s4.47 10 9.99 10C17.52 22 22 17.52 22 12S17.52 2 11.99 2zM12 20c-4.42 0-8-3.58-8-8s3.58-8 8-8 8 3.58 8 8-3.58 8-8 8zm3.5-9c.83 0 1.5-.67 1.5-1.5S16.33 8 15.5 8 14 8.67 14 9.5s.67 1.5 1.5 1.5zm-7 0c.83 0 1.5-.67 1.5-1.5S9.33 8 8.5 8 7 8.67 7 9.5 7.67 11 8.5 11zm3.5 6.5c2.33 0 4.31-1.46 5.11-3.5H6.89c.8 2.04 2.78 3.5 5.11 3.5z"/></svg>`)))
+	iconPin    = theme.NewThemedResource(fyne.NewStaticResource("pin.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M16 9V4h1c.55 0 1-.45 1-1s-.45-1-1-1H7c-.55 0-1 .45-1 1s.45 1 1 1h1v5c0 1.66-1.34 3-3 3v2h5.97v7l1 1 1-1v-7H19v-2c-1.66 0-3-1.34-3-3z"/></svg>`)))
+	iconLink   = theme.NewThemedResource(fyne.NewStaticResource("link.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><path d="M3.9 12c0-1.71 1.39-3.1 3.1-3.1h4V7H7c-2.76 0-5 2.24-5 5s2.24 5 5 5h4v-1.9H7c-1.71 0-3.1-1.39-3.1-3.1zM8 13h8v-2H8v2zm9-6h-4v1.9h4c1.71 0 3.1 1.39 3.1 3.1s-1.39 3.1-3.1 3.1h-4V17h4c2.76 0 5-2.24 5-5s-2.24-5-5-5z"/></svg>`)))
+)
+
+// makeComposer returns the message entry with a formatting toolbar and an optional preview of the formatted text.
+// Formatting is typed as markdown, each service converts it to its own format when the message is sent.
+func (u *ui) makeComposer() fyne.CanvasObject {
+	u.create = newComposerEntry(u.send)
+	u.completer = newCompleter(u.create, u.suggest)
+
+	preview := widget.NewRichText()
+	preview.Wrapping = fyne.TextWrapWord
+	previewBox := container.NewVBox(widget.NewSeparator(), preview)
+	previewBox.Hide()
+	updatePreview := func(text string) {
+		if previewBox.Visible() {
+			preview.Segments = richSegments(parseComposed(text), func(*channel) {}, func(string) {}, func(int) {})
+			preview.Refresh()
+		}
+	}
+	u.create.OnChanged = func(text string) {
+		u.create.grow()
+		u.completer.update()
+		updatePreview(text)
+	}
+
+	var previewAction *widget.ToolbarAction
+	previewAction = widget.NewToolbarAction(theme.VisibilityIcon(), func() {
+		if previewBox.Visible() {
+			previewBox.Hide()
+			previewAction.SetIcon(theme.VisibilityIcon())
+		} else {
+			previewBox.Show()
+			previewAction.SetIcon(theme.VisibilityOffIcon())
+			updatePreview(u.create.Text)
+		}
+	})
+	tools := widget.NewToolbar(
+		widget.NewToolbarAction(iconBold, func() { u.wrapSelection("**") }),
+		widget.NewToolbarAction(iconItalic, func() { u.wrapSelection("*") }),
+		widget.NewToolbarAction(iconStrike, func() { u.wrapSelection("~~") }),
+		widget.NewToolbarAction(iconCode, func() { u.wrapSelection("`") }),
+		widget.NewToolbarAction(iconLink, u.insertLink),
+		widget.NewToolbarSpacer(),
+		previewAction,
+		widget.NewToolbarAction(iconPin, u.showPinned),
+		widget.NewToolbarAction(theme.AccountIcon(), u.members.toggle))
+	tools.Append(widget.NewToolbarAction(theme.SettingsIcon(), func() {
+		u.showSendKeyMenu(tools)
+	}))
+
+	send := widget.NewButtonWithIcon("", theme.MailSendIcon(), func() {
+		u.send(u.create.Text)
+	})
+	var emoji *widget.Button
+	emoji = widget.NewButtonWithIcon("", iconEmoji, func() {
+		u.showEmojiPicker(emoji)
+	})
+	return container.NewBorder(container.NewVBox(u.completer.box, previewBox, tools), nil, nil,
+		container.NewHBox(emoji, send), u.create)
+}
+
+// showSendKeyMenu lets the user choose which key combination sends a message.
+func (u *ui) showSendKeyMenu(from fyne.CanvasObject) {
+	prefs := fyne.CurrentApp().Preferences()
+	current := sendKey()
+	var items []*fyne.MenuItem
+	for _, opt := range sendKeyNames {
+		key := opt.key
+		item := fyne.NewMenuItem(opt.name, func() {
+			prefs.SetString(prefComposerSendKey, key)
+		})
+		item.Checked = key == current
+		items = append(items, item)
+	}
+
+	pos := fyne.CurrentApp().Driver().AbsolutePositionForObject(from)
+	pos = pos.Add(fyne.NewPos(from.Size().Width, 0))
+	widget.ShowPopUpMenuAtPosition(fyne.NewMenu("", items...), u.win.Canvas(), pos)
+}
+
+// insertLink asks for a web address and links the selected text, or the address itself, to it.
+func (u *ui) insertLink() {
+	text := u.create.SelectedText()
+	address := widget.NewEntry()
+	address.SetPlaceHolder("https://")
+	dialog.ShowForm("Insert link", "Insert", "Cancel", []*widget.FormItem{widget.NewFormItem("Address", address)},
+		func(ok bool) {
+			if !ok || address.Text == "" {
+				return
+			}
+
+			if text == "" {
+				u.typeText(address.Text)
+			} else {
+				u.typeText("[" + text + "](" + address.Text + ")")
+			}
+			u.win.Canvas().Focus(u.create)
+		}, u.win)
+}
+
+// typeText inserts text at the cursor, replacing any selection.
+func (u *ui) typeText(text string) {
+	for _, r := range text {
+		u.create.TypedRune(r)
+	}
+}
+
+// wrapSelection surrounds the selected text with a formatting marker.
+// With nothing selected the markers are inserted with the cursor between them, ready to type.
+func (u *ui) wrapSelection(mark string) {
+	text := u.create.SelectedText()
+	u.typeText(mark + text + mark)
+	if text == "" {
+		u.create.CursorColumn -= len([]rune(mark))
+		u.create.Refresh()
+	}
+	u.win.Canvas().Focus(u.create)
+}
+
+// composerEntry is a multi-line entry that sends its text when the key combination chosen in preferences is typed.
+// Other combinations of Enter start a new line, and the entry grows with its content up to composerMaxRows.
+type composerEntry struct {
+	widget.Entry
+	onSend func(string)
+	onKey  func(*fyne.KeyEvent) bool // handles keys before the entry does, returning true if used
+	tags   map[string]string         // tokens for mentions and custom emoji chosen, by the text inserted for them
+
+	shift bool
+	rows  int
+}
+
+func newComposerEntry(onSend func(string)) *composerEntry {
+	e := &composerEntry{onSend: onSend, rows: 1, tags: make(map[string]string)}
+	e.MultiLine = true
+	e.Wrapping = fyne.TextWrapWord
+	e.ExtendBaseWidget(e)
+	e.SetMinRowsVisible(1)
+	return e
+}
+
+// grow sets the height of the entry to fit its lines of text.
+func (e *composerEntry) grow() {
+	rows := strings.Count(e.Text, "\n") + 1
+	if rows > composerMaxRows {
+		rows = composerMaxRows
+	}
+	if rows == e.rows {
+		return
+	}
+
+	e.rows = rows
+	e.SetMinRowsVisible(rows)
+}
+
+func (e *composerEntry) KeyDown(key *fyne.KeyEvent) {
+	if key.Name == desktop.KeyShiftLeft || key.Name == desktop.KeyShiftRight {
+		e.shift = true
+	}
+	e.Entry.KeyDown(key)
+}
+
+func (e *composerEntry) KeyUp(key *fyne.KeyEvent) {
+	if key.Name == desktop.KeyShiftLeft || key.Name == desktop.KeyShiftRight {
+		e.shift = false
+	}
+	e.Entry.KeyUp(key)
+}
+
+func (e *composerEntry) TypedKey(key *fyne.KeyEvent) {
+	if e.onKey != nil && e.onKey(key) {
+		return
+	}
+	if key.Name != fyne.KeyReturn && key.Name != fyne.KeyEnter {
+		e.Entry.TypedKey(key)
+		return
+	}
+
+	switch sendKey() {
+	case sendOnEnter:
+		if !e.shift {
+			e.onSend(e.Text)
+			return
+		}
+	case sendOnShiftEnter:
+		if e.shift {
+			e.onSend(e.Text)
+			return
+		}
+	}
+	e.newLine()
+}
+
+func (e *composerEntry) TypedShortcut(s fyne.Shortcut) {
+	custom, ok := s.(*desktop.CustomShortcut)
+	if !ok || (custom.KeyName != fyne.KeyReturn && custom.KeyName != fyne.KeyEnter) ||
+		custom.Modifier != fyne.KeyModifierControl {
+		e.Entry.TypedShortcut(s)
+		return
+	}
+
+	if sendKey() == sendOnCtrlEnter {
+		e.onSend(e.Text)
+		return
+	}
+	e.newLine()
+}
+
+// setDraft replaces the text of the entry, leaving the cursor at the end ready to carry on typing.
+func (e *composerEntry) setDraft(text string) {
+	e.tags = make(map[string]string)
+	e.SetText(text)
+	lines := strings.Split(text, "\n")
+	e.CursorRow = len(lines) - 1
+	e.CursorColumn = len([]rune(lines[len(lines)-1]))
+	e.Refresh()
+}
+
+// replaceWord replaces the text between column start and the cursor on the current row.
+func (e *composerEntry) replaceWord(start int, text string) {
+	lines := strings.Split(e.Text, "\n")
+	line := []rune(lines[e.CursorRow])
+	lines[e.CursorRow] = string(line[:start]) + text + string(line[e.CursorColumn:])
+
+	e.SetText(strings.Join(lines, "\n"))
+	e.CursorColumn = start + len([]rune(text))
+	e.Refresh()
+}
+
+// tagged returns text with emoji shortcodes replaced, and the mentions and custom emoji that were picked
+// changed into the tokens that the services send.
+func (e *composerEntry) tagged(text string) string {
+	text = emojiCodePattern.ReplaceAllStringFunc(text, func(code string) string {
+		if _, ok := e.tags[code]; ok {
+			return code // a custom emoji with the same name as a standard one
+		}
+		if emoji := emojiShortcode(strings.Trim(code, ":")); emoji != "" {
+			return emoji
+		}
+		return code
+	})
+
+	names := make([]string, 0, len(e.tags))
+	for name := range e.tags {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { // longest first, so "@Jo" does not match inside "@John"
+		return len(names[i]) > len(names[j])
+	})
+	for _, name := range names {
+		text = strings.ReplaceAll(text, name, e.tags[name])
+	}
+	return text
+}
+
+// newLine inserts a line break at the cursor.
+func (e *composerEntry) newLine() {
+	e.Entry.TypedKey(&fyne.KeyEvent{Name: fyne.KeyReturn})
+}
+
+// sendKey returns which key combination the user chose to send messages with.
+func sendKey() string {
+	return fyne.CurrentApp().Preferences().StringWithFallback(prefComposerSendKey, sendOnEnter)
+}
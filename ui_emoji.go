@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+// emojiPickerSize is how much room the emoji picker pop-up takes.
+var emojiPickerSize = fyne.NewSize(340, 320)
+
+// showEmojiPicker shows recent, custom and standard emoji above the button from, tapping one inserts it.
+func (u *ui) showEmojiPicker(from fyne.CanvasObject) {
+	var pop *widget.PopUp
+	pick := func(insert func()) func() {
+		return func() {
+			pop.Hide()
+			insert()
+			u.win.Canvas().Focus(u.create)
+		}
+	}
+
+	sections := container.NewVBox()
+	fill := func(query string) {
+		sections.Objects = nil
+		addSection := func(title string, items []fyne.CanvasObject) {
+			if len(items) == 0 {
+				return
+			}
+			sections.Add(widget.NewLabelWithStyle(title, fyne.TextAlignLeading, fyne.TextStyle{Bold: true}))
+			sections.Add(container.NewGridWrap(fyne.NewSize(40, 40), items...))
+		}
+
+		custom := u.targetEmojis()
+		if query == "" {
+			var recent []fyne.CanvasObject
+			for _, r := range recentEmoji() {
+				if e := findEmojiToken(custom, r); e != nil {
+					recent = append(recent, u.customEmojiButton(e, pick))
+				} else if !composerEmoji.MatchString(r) {
+					r := r
+					recent = append(recent, emojiButton(r, pick(func() { u.insertEmoji(r) })))
+				}
+			}
+			addSection("Recent", recent)
+		}
+
+		var customs, standard []fyne.CanvasObject
+		for _, e := range custom {
+			if strings.Contains(strings.ToLower(e.name), strings.ToLower(query)) {
+				customs = append(customs, u.customEmojiButton(e, pick))
+			}
+		}
+		for _, e := range matchEmoji(query) {
+			emoji := e.emoji
+			standard = append(standard, emojiButton(emoji, pick(func() { u.insertEmoji(emoji) })))
+		}
+		addSection("Custom", customs)
+		addSection("Emoji", standard)
+		sections.Refresh()
+	}
+
+	search := widget.NewEntry()
+	search.SetPlaceHolder("Search emoji")
+	search.OnChanged = fill
+	fill("")
+
+	pop = widget.NewPopUp(container.NewBorder(search, nil, nil, nil, container.NewVScroll(sections)),
+		u.win.Canvas())
+	pop.Resize(emojiPickerSize)
+	pos := fyne.CurrentApp().Driver().AbsolutePositionForObject(from)
+	pos = pos.Add(fyne.NewPos(from.Size().Width-emojiPickerSize.Width, -emojiPickerSize.Height))
+	pop.ShowAtPosition(pos)
+	u.win.Canvas().Focus(search)
+}
+
+// emojiButton returns a button showing a standard emoji.
+func emojiButton(emoji string, tapped func()) fyne.CanvasObject {
+	b := widget.NewButton(emoji, tapped)
+	b.Importance = widget.LowImportance
+	return b
+}
+
+// customEmojiButton returns a button for a custom emoji, showing its name until the image loads.
+func (u *ui) customEmojiButton(e *customEmoji, pick func(func()) func()) fyne.CanvasObject {
+	b := widget.NewButton(":"+e.name+":", pick(func() { u.insertCustomEmoji(e) }))
+	b.Importance = widget.LowImportance
+	if e.imageURL == "" {
+		if e.alt != "" {
+			b.SetText(e.alt)
+		}
+		return b
+	}
+
+	go func() {
+		res, err := fyne.LoadResourceFromURLString(e.imageURL)
+		if err != nil {
+			fyne.LogError("Failed to load emoji "+e.name, err)
+			return
+		}
+		b.SetText("")
+		b.SetIcon(res)
+	}()
+	return b
+}
+
+// insertEmoji types a standard emoji into the composer.
+func (u *ui) insertEmoji(emoji string) {
+	u.typeText(emoji)
+	addRecentEmoji(emoji)
+}
+
+// insertCustomEmoji types the name of a custom emoji into the composer, to be sent as the emoji.
+func (u *ui) insertCustomEmoji(e *customEmoji) {
+	u.typeText(":" + e.name + ":")
+	u.create.tags[":"+e.name+":"] = emojiToken(e)
+	addRecentEmoji(emojiToken(e))
+}
+
+// suggestEmoji offers custom and standard emoji whose name starts with, or else contains, the text typed.
+func (u *ui) suggestEmoji(text string) []completion {
+	query := strings.ToLower(text)
+	var starts, contains []completion
+	for _, e := range u.targetEmojis() {
+		e := e
+		item := completion{label: ":" + e.name + ":", insert: ":" + e.name + ":", picked: func() {
+			u.create.tags[":"+e.name+":"] = emojiToken(e)
+			addRecentEmoji(emojiToken(e))
+		}}
+		name := strings.ToLower(e.name)
+		if strings.HasPrefix(name, query) {
+			starts = append(starts, item)
+		} else if strings.Contains(name, query) {
+			contains = append(contains, item)
+		}
+	}
+
+	list := append(starts, contains...)
+	for _, e := range matchEmoji(query) {
+		emoji := e.emoji
+		list = append(list, completion{label: emoji + "  :" + e.code + ":", insert: emoji, picked: func() {
+			addRecentEmoji(emoji)
+		}})
+	}
+	return list
+}
+
+// targetEmojis returns the custom emoji that can be sent where the composer is sending to.
+// They are loaded from the service the first time.
+func (u *ui) targetEmojis() []*customEmoji {
+	ch := u.replyTarget()
+	if ch == nil || ch.server.service == nil {
+		return nil
+	}
+
+	srv := ch.server
+	if srv.emojis == nil && !u.loadingEmojis[srv] {
+		u.loadingEmojis[srv] = true
+		go func() {
+			list, err := srv.service.emojis(srv)
+			if err != nil {
+				fyne.LogError("Failed to load emoji for "+srv.name, err)
+			}
+			srv.emojis = append([]*customEmoji{}, list...) // not nil, so that we do not ask again
+			u.completer.update()
+		}()
+	}
+	return srv.emojis
+}
+
+// findEmojiToken returns the emoji in list that token, as made by emojiToken, refers to.
+func findEmojiToken(list []*customEmoji, token string) *customEmoji {
+	for _, e := range list {
+		if emojiToken(e) == token {
+			return e
+		}
+	}
+	return nil
+}
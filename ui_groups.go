@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// makeAddChannel returns a button that offers to join or create a channel on the current server.
+func (u *ui) makeAddChannel() fyne.CanvasObject {
+	var b *widget.Button
+	b = widget.NewButtonWithIcon("", theme.ContentAddIcon(), func() {
+		srv := u.currentServer
+		if srv == nil || srv.service == nil {
+			return
+		}
+
+		menu := fyne.NewMenu("",
+			fyne.NewMenuItem("Join with a link or invite…", func() {
+				u.showJoin(srv)
+			}),
+			fyne.NewMenuItem("New group…", func() {
+				u.showCreateGroup(srv)
+			}))
+		pos := fyne.CurrentApp().Driver().AbsolutePositionForObject(b)
+		widget.ShowPopUpMenuAtPosition(menu, u.win.Canvas(), pos.AddXY(0, b.Size().Height))
+	})
+	b.Importance = widget.LowImportance
+	return b
+}
+
+// showJoin asks for an invite or link to join on the service of srv.
+func (u *ui) showJoin(srv *server) {
+	link := widget.NewEntry()
+	link.SetPlaceHolder("Invite link, code or @name")
+	dialog.ShowForm("Join on "+srv.name, "Join", "Cancel", []*widget.FormItem{widget.NewFormItem("Link", link)},
+		func(ok bool) {
+			if !ok || strings.TrimSpace(link.Text) == "" {
+				return
+			}
+			go u.join(srv, strings.TrimSpace(link.Text))
+		}, u.win)
+}
+
+// join asks the service of srv to join from link, opening the channel if it worked.
+func (u *ui) join(srv *server, link string) {
+	ch, err := srv.service.join(link)
+	if err != nil {
+		dialog.ShowError(err, u.win)
+		return
+	}
+	u.showNewChannel(ch)
+}
+
+// showCreateGroup asks for a name and the people of srv to start a group with.
+func (u *ui) showCreateGroup(srv *server) {
+	people := make(map[string]*user)
+	var names []string
+	userLock.RLock()
+	for _, usr := range srv.users {
+		name := usr.displayName()
+		if _, ok := people[name]; ok && usr.username != "" {
+			name += " (" + usr.username + ")"
+		}
+		people[name] = usr
+		names = append(names, name)
+	}
+	userLock.RUnlock()
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+
+	name := widget.NewEntry()
+	choose := widget.NewCheckGroup(names, nil)
+	list := container.NewVScroll(choose)
+	list.SetMinSize(fyne.NewSize(0, 240))
+	d := dialog.NewForm("New group on "+srv.name, "Create", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Name", name), widget.NewFormItem("People", list)},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			var chosen []*user
+			for _, n := range choose.Selected {
+				chosen = append(chosen, people[n])
+			}
+			if len(chosen) == 0 {
+				dialog.ShowError(errors.New("choose the people to add to the group"), u.win)
+				return
+			}
+
+			go func() {
+				ch, err := srv.service.createGroup(strings.TrimSpace(name.Text), chosen)
+				if err != nil {
+					dialog.ShowError(err, u.win)
+					return
+				}
+				u.showNewChannel(ch)
+			}()
+		}, u.win)
+	d.Resize(fyne.NewSize(400, 0))
+	d.Show()
+}
+
+// confirmLeave checks that the user wants to leave ch before asking the service.
+func (u *ui) confirmLeave(ch *channel) {
+	dialog.ShowConfirm("Leave "+ch.name, "You will stop getting its messages and may need an invite to come back.",
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			go func() {
+				if err := ch.server.service.leave(ch); err != nil {
+					dialog.ShowError(err, u.win)
+				}
+			}()
+		}, u.win)
+}
+
+// confirmLeaveServer checks that the user wants to leave the whole of srv, and all its channels, before asking
+// the service.
+func (u *ui) confirmLeaveServer(srv *server) {
+	dialog.ShowConfirm("Leave server "+srv.name, "You will leave every channel on "+srv.name+
+		" and will need an invite to come back.",
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			go func() {
+				if err := srv.service.leaveServer(srv); err != nil {
+					dialog.ShowError(err, u.win)
+				}
+			}()
+		}, u.win)
+}
+
+// showNewChannel opens a channel that a service just added, adding its server to the list if that is new too.
+func (u *ui) showNewChannel(ch *channel) {
+	known := false
+	for _, s := range u.data.servers {
+		known = known || s == ch.server
+	}
+	if !known {
+		u.addServers(ch.server)
+	}
+	u.channels.Refresh()
+	u.openChannel(ch)
+}
+
+// removeChannel takes ch out of its server after the user left it, showing another channel if it was open.
+func (u *ui) removeChannel(ch *channel) {
+	srv := ch.server
+	for i, c := range srv.channels {
+		if c == ch {
+			srv.channels = append(srv.channels[:i:i], srv.channels[i+1:]...)
+			break
+		}
+	}
+
+	if ch == u.currentChannel {
+		u.showServerChannels()
+	} else if srv == u.currentServer {
+		u.channels.Refresh()
+	}
+}
+
+// removeServer takes srv out of the server list after the user left it, showing the inbox if it was open.
+func (u *ui) removeServer(srv *server) {
+	if u.data == nil {
+		return
+	}
+	for i, s := range u.data.servers {
+		if s == srv {
+			u.data.servers = append(u.data.servers[:i:i], u.data.servers[i+1:]...)
+			break
+		}
+	}
+	u.servers.Refresh()
+
+	if srv == u.currentServer {
+		u.selectServer(u.inbox)
+	} else if u.currentChannel != nil {
+		u.openChannel(u.currentChannel) // the list moved up, select it where it is now
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	prefMembersShowKey = "members.show"
+
+	memberPanelWidth = 200
+	presenceDotSize  = 10
+)
+
+// memberPanel lists the people in the current channel, those who are online first.
+type memberPanel struct {
+	content *fyne.Container
+	list    *widget.List
+	title   *widget.Label
+
+	channel  *channel
+	members  []*member
+	onTapped func(*member)
+}
+
+func newMemberPanel(onTapped func(*member)) *memberPanel {
+	p := &memberPanel{onTapped: onTapped}
+	p.title = widget.NewLabelWithStyle("Members", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	p.list = widget.NewList(
+		func() int {
+			return len(p.members)
+		},
+		func() fyne.CanvasObject {
+			return newMemberRow()
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			o.(*memberRow).setMember(p.members[id])
+		})
+	p.list.OnSelected = func(id widget.ListItemID) {
+		p.list.Unselect(id)
+		if p.onTapped != nil {
+			p.onTapped(p.members[id])
+		}
+	}
+
+	width := canvas.NewRectangle(color.Transparent)
+	width.SetMinSize(fyne.NewSize(memberPanelWidth, 0))
+	p.content = container.NewBorder(p.title, nil, nil, nil, container.NewStack(width, p.list))
+	if !fyne.CurrentApp().Preferences().BoolWithFallback(prefMembersShowKey, true) {
+		p.content.Hide()
+	}
+	return p
+}
+
+// setChannel shows the members of ch, or nobody if it is nil.
+func (p *memberPanel) setChannel(ch *channel) {
+	p.channel = ch
+	p.refresh()
+	p.list.ScrollToTop()
+}
+
+// refresh updates the list after members are loaded or their presence changes.
+// For voice channels it lists the people connected.
+func (p *memberPanel) refresh() {
+	p.members = nil
+	title := "Members"
+	if p.channel != nil && p.channel.voice {
+		title = "Connected"
+		for _, usr := range p.channel.talking {
+			p.members = append(p.members, &member{user: usr})
+		}
+	} else if p.channel != nil {
+		p.members = append(p.members, p.channel.memberList()...)
+	}
+	sort.SliceStable(p.members, func(i, j int) bool {
+		a, b := presenceOrder(p.members[i].user.presence), presenceOrder(p.members[j].user.presence)
+		if a != b {
+			return a < b
+		}
+		return strings.ToLower(p.members[i].user.displayName()) < strings.ToLower(p.members[j].user.displayName())
+	})
+
+	if len(p.members) == 0 {
+		p.title.SetText(title)
+	} else {
+		p.title.SetText(title + " — " + strconv.Itoa(len(p.members)))
+	}
+	p.list.Refresh()
+}
+
+// toggle shows or hides the panel, remembering the choice.
+func (p *memberPanel) toggle() {
+	if p.content.Visible() {
+		p.content.Hide()
+	} else {
+		p.content.Show()
+	}
+	fyne.CurrentApp().Preferences().SetBool(prefMembersShowKey, p.content.Visible())
+}
+
+type memberRow struct {
+	widget.BaseWidget
+	pic   *widget.Icon
+	dot   *canvas.Circle
+	name  *widget.Label
+	roles *widget.Label
+
+	member *member
+}
+
+func newMemberRow() *memberRow {
+	r := &memberRow{pic: widget.NewIcon(nil), dot: canvas.NewCircle(color.Transparent),
+		name: widget.NewLabel(""), roles: widget.NewLabel("")}
+	r.name.Truncation = fyne.TextTruncateEllipsis
+	r.roles.Truncation = fyne.TextTruncateEllipsis
+	r.roles.Importance = widget.LowImportance
+	r.roles.TextStyle.Italic = true
+	r.ExtendBaseWidget(r)
+	return r
+}
+
+func (r *memberRow) CreateRenderer() fyne.WidgetRenderer {
+	dot := container.NewCenter(container.NewGridWrap(fyne.NewSize(presenceDotSize, presenceDotSize), r.dot))
+	return widget.NewSimpleRenderer(container.NewBorder(nil, nil, container.NewHBox(r.pic, dot), nil,
+		container.NewVBox(r.name, r.roles)))
+}
+
+func (r *memberRow) setMember(m *member) {
+	r.member = m
+	r.name.SetText(m.user.displayName())
+	r.roles.SetText(strings.Join(m.roles, ", "))
+	if len(m.roles) == 0 {
+		r.roles.Hide()
+	} else {
+		r.roles.Show()
+	}
+	r.dot.FillColor = presenceColor(m.user.presence)
+	r.dot.Refresh()
+
+	r.pic.SetResource(theme.AccountIcon())
+	go func() {
+		res := m.user.avatar()
+		if res != nil && r.member == m { // the row may have been reused while we loaded
+			r.pic.SetResource(res)
+		}
+	}()
+}
+
+// presenceColor returns the colour of the dot shown next to someone with presence p.
+func presenceColor(p presence) color.Color {
+	switch p {
+	case presenceOnline:
+		return theme.SuccessColor()
+	case presenceAway:
+		return theme.WarningColor()
+	case presenceBusy:
+		return theme.ErrorColor()
+	case presenceOffline:
+		return theme.DisabledColor()
+	}
+	return color.Transparent
+}
+
+// presenceName describes presence p to the user.
+func presenceName(p presence) string {
+	switch p {
+	case presenceOnline:
+		return "Online"
+	case presenceAway:
+		return "Away"
+	case presenceBusy:
+		return "Do not disturb"
+	case presenceOffline:
+		return "Offline"
+	}
+	return "Unknown"
+}
+
+// presenceOrder sorts the people who are around to chat before those who are not.
+func presenceOrder(p presence) int {
+	switch p {
+	case presenceOnline:
+		return 0
+	case presenceBusy:
+		return 1
+	case presenceAway:
+		return 2
+	case presenceUnknown:
+		return 3
+	}
+	return 4
+}
+
+// memberTapped shows the profile of m beside the member list.
+func (u *ui) memberTapped(m *member) {
+	if u.currentChannel == nil {
+		return
+	}
+
+	pos := fyne.CurrentApp().Driver().AbsolutePositionForObject(u.members.content)
+	u.showProfile(m.user, u.currentChannel.server, m.roles, pos.SubtractXY(profileWidth, 0))
+}
+
+// presenceChanged is called by services when someone's presence changes.
+func (u *ui) presenceChanged() {
+	u.members.refresh()
+}
+
+// voiceChanged is called by services when someone joins or leaves a voice channel.
+func (u *ui) voiceChanged() {
+	u.channels.Refresh()
+	u.members.refresh()
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"hash/fnv"
+	"io"
+	"net/url"
+	"strconv"
 	"sync"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
@@ -16,9 +23,234 @@ var (
 	resCacheLock sync.RWMutex
 )
 
+// messageList shows the messages of a channel in a list that only creates cells for the visible rows.
+// Rows have different heights, so each is measured when it is shown and remembered for its message.
+type messageList struct {
+	list       *widget.List
+	banner     *widget.Button
+	content    fyne.CanvasObject
+	channel    *channel // the channel the rows belong to
+	items      []*message
+	heights    map[*message]float32
+	rowHeights map[widget.ListItemID]float32 // what we told the list, so we can work out where the bottom is
+	template   float32
+	width      float32
+	unseen     int // messages added below the visible area since the user was at the bottom
+
+	showSource bool                          // set when the messages are from many channels, such as in the inbox
+	unreadFrom *message                      // the first message that arrived after the channel was last read
+	onChannel  func(*channel)                // called when the user taps a link to a channel
+	onFile     func(string)                  // called when the user taps an attachment, with its URI
+	onTapped   func(*message)                // optional, called when the user taps a message
+	onMenu     func(*message, fyne.Position) // called when the user right clicks a message
+	onUser     func(*message, fyne.Position) // called when the user taps the name or picture of an author
+}
+
+func newMessageList() *messageList {
+	l := &messageList{heights: make(map[*message]float32), rowHeights: make(map[widget.ListItemID]float32)}
+	l.banner = widget.NewButtonWithIcon("", theme.MoveDownIcon(), l.scrollToBottom)
+	l.banner.Importance = widget.HighImportance
+	l.banner.Hide()
+	l.list = widget.NewList(
+		func() int {
+			return len(l.items)
+		},
+		func() fyne.CanvasObject {
+			return newMessageCell(&message{})
+		},
+		l.updateCell)
+	l.list.HideSeparators = true
+	l.list.OnSelected = func(id widget.ListItemID) {
+		l.list.Unselect(id)
+		if l.onTapped != nil && id < len(l.items) {
+			l.onTapped(l.items[id])
+		}
+	}
+	l.content = container.NewBorder(nil, l.banner, nil, nil, l.list)
+	return l
+}
+
+// append adds messages to the bottom of the list, above any messages that are waiting to send.
+// If the user was reading at the bottom we follow the new messages, otherwise we offer to jump to them.
+func (l *messageList) append(list []*message) {
+	bottom := l.atBottom()
+	var items, pending []*message
+	for _, m := range l.items {
+		if m.outgoing != nil {
+			pending = append(pending, m)
+		} else {
+			items = append(items, m)
+		}
+	}
+	l.set(l.channel, append(append(items, list...), pending...))
+
+	if bottom {
+		l.scrollToBottom()
+		return
+	}
+	for _, m := range list {
+		if m.outgoing == nil {
+			l.unseen++
+		}
+	}
+	l.refreshBanner()
+}
+
+// atBottom returns true if the last message is in view, working out the height of the list the same way it does.
+func (l *messageList) atBottom() bool {
+	if len(l.items) == 0 {
+		return true
+	}
+
+	pad := theme.Padding()
+	height := -pad
+	for i := range l.items {
+		h, ok := l.rowHeights[i]
+		if !ok {
+			h = l.templateHeight()
+		}
+		height += h + pad
+	}
+	return l.list.GetScrollOffset()+l.list.Size().Height >= height-pad*2
+}
+
+// lastRead returns the id of the newest message that has been received, for remembering where we read to.
+func (l *messageList) lastRead() string {
+	for i := len(l.items) - 1; i >= 0; i-- {
+		if l.items[i].outgoing == nil && l.items[i].id != "" {
+			return l.items[i].id
+		}
+	}
+	return ""
+}
+
+func (l *messageList) refreshBanner() {
+	if l.unseen == 0 {
+		l.banner.Hide()
+		return
+	}
+
+	text := "1 new message"
+	if l.unseen > 1 {
+		text = strconv.Itoa(l.unseen) + " new messages"
+	}
+	l.banner.SetText(text + " — jump to latest")
+	l.banner.Show()
+}
+
+func (l *messageList) setHeight(id widget.ListItemID, h float32) {
+	l.rowHeights[id] = h
+	l.list.SetItemHeight(id, h)
+}
+
+// templateHeight returns the height the list gives rows that have not been measured.
+func (l *messageList) templateHeight() float32 {
+	if l.template == 0 {
+		l.template = newMessageCell(&message{}).MinSize().Height
+	}
+	return l.template
+}
+
+// set replaces the messages shown for ch, keeping the heights of any rows we have measured before.
+// The row heights are reset when ch is another channel, as the rows then hold different messages.
+func (l *messageList) set(ch *channel, list []*message) {
+	if ch != l.channel {
+		l.channel = ch
+		for id := range l.rowHeights {
+			l.list.SetItemHeight(id, l.templateHeight())
+		}
+		l.rowHeights = make(map[widget.ListItemID]float32)
+	}
+	l.items = list
+	for i, m := range list {
+		if h, ok := l.heights[m]; ok {
+			l.setHeight(i, h)
+		}
+	}
+	l.list.Refresh()
+}
+
+// show replaces the messages with those of ch, usually a different channel, restoring the scroll offset unless following the latest.
+// The unread message, if not nil, has a divider drawn above it.
+func (l *messageList) show(ch *channel, list []*message, unread *message, offset float32, follow bool) {
+	delete(l.heights, l.unreadFrom) // the divider changes the height of the row
+	delete(l.heights, unread)
+	l.unreadFrom = unread
+	l.unseen = 0
+	l.refreshBanner()
+	l.set(ch, list)
+	if follow {
+		l.list.ScrollToBottom()
+	} else {
+		l.list.ScrollToOffset(offset)
+	}
+}
+
+func (l *messageList) scrollToBottom() {
+	l.list.ScrollToBottom()
+	l.unseen = 0
+	l.refreshBanner()
+}
+
+// scrollTo moves the list so the message with id is visible, returning false if it is not in the list.
+func (l *messageList) scrollTo(id string) bool {
+	for i, m := range l.items {
+		if m.id == id {
+			l.list.ScrollTo(i)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *messageList) updateCell(id widget.ListItemID, o fyne.CanvasObject) {
+	if id >= len(l.items) {
+		return
+	}
+
+	if id == len(l.items)-1 && l.unseen > 0 { // the user scrolled down to the latest message
+		l.unseen = 0
+		l.refreshBanner()
+	}
+
+	cell := o.(*messageCell)
+	msg := l.items[id]
+	cell.showSource = l.showSource
+	cell.unreadDivider = msg == l.unreadFrom
+	cell.onChannel = l.onChannel
+	cell.onFile = l.onFile
+	cell.onUser = l.onUser
+	cell.onMenu = l.onMenu
+	cell.onChanged = func() {
+		delete(l.heights, msg)
+		l.list.RefreshItem(id)
+	}
+	cell.setMessage(msg)
+
+	if w := cell.Size().Width; w != l.width { // wrapping changed, measure again as rows are shown
+		l.width = w
+		l.heights = make(map[*message]float32)
+	}
+	h, ok := l.heights[msg]
+	if !ok {
+		h = cell.MinSize().Height
+		l.heights[msg] = h
+	}
+	l.setHeight(id, h)
+}
+
 type messageCell struct {
 	widget.BaseWidget
 	msg *message
+
+	showSource    bool // set when the cell is shown outside its channel, such as in the inbox
+	unreadDivider bool // set to draw the "new messages" line above this message
+
+	onChannel func(*channel)                // called when a channel link in the message is tapped
+	onFile    func(string)                  // called when an attachment in the message is tapped
+	onChanged func()                        // called when the content changes size, such as revealing a spoiler
+	onMenu    func(*message, fyne.Position) // called when the message is right clicked
+	onUser    func(*message, fyne.Position) // called when the author's name or picture is tapped
 }
 
 func newMessageCell(m *message) *messageCell {
@@ -27,28 +259,119 @@ func newMessageCell(m *message) *messageCell {
 	return ret
 }
 
-func (m *messageCell) avatarResource() fyne.Resource {
-	if m.msg.user == nil || m.msg.user.avatarURL == "" {
+// avatar returns the picture of usr, loading it the first time. It should be called away from the UI goroutine.
+func (usr *user) avatar() fyne.Resource {
+	if usr == nil || usr.avatarURL == "" {
 		return nil
 	}
 
 	resCacheLock.RLock()
-	ret, ok := resCache[m.msg.user.avatarURL]
+	ret, ok := resCache[usr.avatarURL]
 	resCacheLock.RUnlock()
 	if ok {
 		return ret
 	}
-	url, err := storage.ParseURI(m.msg.user.avatarURL)
+	url, err := storage.ParseURI(usr.avatarURL)
 	if err != nil || url == nil {
 		return nil
 	}
-	ret, _ = storage.LoadResourceFromURI(url)
+	ret, err = storage.LoadResourceFromURI(url)
+	if err != nil {
+		fyne.LogError("Failed to load avatar "+usr.avatarURL, err)
+		return nil // not cached, so that we try again next time it is shown
+	}
 	resCacheLock.Lock()
-	resCache[m.msg.user.avatarURL] = ret
+	resCache[usr.avatarURL] = ret
 	resCacheLock.Unlock()
 	return ret
 }
 
+// openFile opens the attachment at uri with the program the system uses for it, downloading it into the app's
+// storage first unless it is a local file.
+func (u *ui) openFile(uri string) {
+	go func() {
+		src, err := storage.ParseURI(uri)
+		if err == nil && src.Scheme() != "file" {
+			src, err = cacheFile(src)
+		}
+		var open *url.URL
+		if err == nil {
+			open, err = url.Parse(src.String())
+		}
+		if err == nil {
+			err = fyne.CurrentApp().OpenURL(open)
+		}
+		if err != nil {
+			dialog.ShowError(err, u.win)
+		}
+	}()
+}
+
+// cacheFile copies the file at src into the app's storage, unless it was already, returning the copy.
+func cacheFile(src fyne.URI) (fyne.URI, error) {
+	dir, err := storage.Child(fyne.CurrentApp().Storage().RootURI(), "files")
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := storage.Exists(dir); !ok {
+		if err = storage.CreateListable(dir); err != nil {
+			return nil, err
+		}
+	}
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(src.String()))
+	dest, err := storage.Child(dir, strconv.FormatUint(hash.Sum64(), 16)+src.Extension())
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := storage.Exists(dest); ok {
+		return dest, nil
+	}
+
+	r, err := storage.Reader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	w, err := storage.Writer(dest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		_ = w.Close()
+		_ = storage.Delete(dest)
+		return nil, err
+	}
+	return dest, w.Close()
+}
+
+// reveal shows the spoiler at index i of the rich content, it stays visible for the rest of the session.
+func (m *messageCell) reveal(i int) {
+	m.msg.rich[i].style &^= richSpoiler
+	m.Refresh()
+	if m.onChanged != nil {
+		m.onChanged()
+	}
+}
+
+func (m *messageCell) openChannel(ch *channel) {
+	if m.onChannel != nil {
+		m.onChannel(ch)
+	}
+}
+
+func (m *messageCell) openFile(uri string) {
+	if m.onFile != nil {
+		m.onFile(uri)
+	}
+}
+
+func (m *messageCell) TappedSecondary(ev *fyne.PointEvent) {
+	if m.onMenu != nil {
+		m.onMenu(m.msg, ev.AbsolutePosition)
+	}
+}
+
 func (m *messageCell) setMessage(new *message) {
 	m.msg = new
 	m.Refresh()
@@ -59,17 +382,53 @@ func (m *messageCell) CreateRenderer() fyne.WidgetRenderer {
 	name.Wrapping = fyne.TextTruncate
 	body := widget.NewRichText()
 	body.Wrapping = fyne.TextWrapWord
-	return &messageRenderer{m: m,
+
+	status := widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Italic: true})
+	retry := widget.NewButtonWithIcon("Retry", theme.ViewRefreshIcon(), func() {
+		if out := m.msg.outgoing; out != nil {
+			out.retry()
+		}
+	})
+	retry.Importance = widget.LowImportance
+	discard := widget.NewButtonWithIcon("Discard", theme.DeleteIcon(), func() {
+		if out := m.msg.outgoing; out != nil {
+			out.discard()
+		}
+	})
+	discard.Importance = widget.LowImportance
+	divider := canvas.NewText("New messages", theme.ErrorColor())
+	divider.TextSize = theme.CaptionTextSize()
+	divider.TextStyle.Bold = true
+	divider.Alignment = fyne.TextAlignTrailing
+	dividerLine := canvas.NewRectangle(theme.ErrorColor())
+	userTapped := func(ev *fyne.PointEvent) {
+		if m.onUser != nil && m.msg.user != nil {
+			m.onUser(m.msg, ev.AbsolutePosition)
+		}
+	}
+	return &messageRenderer{m: m, divider: divider, dividerLine: dividerLine,
+		picTap: newTapTarget(userTapped), nameTap: newTapTarget(userTapped),
 		top:  name,
-		main: body, pic: widget.NewIcon(nil), sep: widget.NewSeparator()}
+		main: body, pic: widget.NewIcon(nil), sep: widget.NewSeparator(),
+		status: status, retry: retry, discard: discard,
+		sending: container.NewHBox(status, retry, discard)}
 }
 
 type messageRenderer struct {
-	m    *messageCell
+	m           *messageCell
+	divider     *canvas.Text
+	dividerLine *canvas.Rectangle
+
 	top  *widget.Label
 	main *widget.RichText
 	pic  *widget.Icon
 	sep  *widget.Separator
+
+	picTap, nameTap *tapTarget
+
+	status         *widget.Label
+	retry, discard *widget.Button
+	sending        *fyne.Container
 }
 
 func (m *messageRenderer) Destroy() {
@@ -78,12 +437,28 @@ func (m *messageRenderer) Destroy() {
 func (m *messageRenderer) Layout(s fyne.Size) {
 	remainWidth := s.Width - iconSize - theme.Padding()*2
 	remainStart := iconSize + theme.Padding()*2
+	top := m.dividerHeight()
+	if top > 0 {
+		textSize := m.divider.MinSize()
+		m.divider.Move(fyne.NewPos(s.Width-textSize.Width-theme.Padding(), 0))
+		m.divider.Resize(textSize)
+		m.dividerLine.Move(fyne.NewPos(0, textSize.Height/2))
+		m.dividerLine.Resize(fyne.NewSize(s.Width-textSize.Width-theme.Padding()*2, 1))
+	}
+
 	m.pic.Resize(fyne.NewSize(iconSize, iconSize))
-	m.pic.Move(fyne.NewPos(theme.Padding(), theme.Padding()))
-	m.top.Move(fyne.NewPos(remainStart, -theme.Padding()))
+	m.pic.Move(fyne.NewPos(theme.Padding(), top+theme.Padding()))
+	m.top.Move(fyne.NewPos(remainStart, top-theme.Padding()))
 	m.top.Resize(fyne.NewSize(remainWidth, m.top.MinSize().Height))
-	m.main.Move(fyne.NewPos(remainStart, m.top.MinSize().Height-theme.Padding()*4))
+	m.picTap.Move(m.pic.Position())
+	m.picTap.Resize(m.pic.Size())
+	m.nameTap.Move(m.top.Position().AddXY(theme.InnerPadding(), theme.InnerPadding()))
+	m.nameTap.Resize(fyne.NewSize(fyne.Min(remainWidth, fyne.MeasureText(m.top.Text, theme.TextSize(),
+		m.top.TextStyle).Width), m.top.MinSize().Height-theme.InnerPadding()*2))
+	m.main.Move(fyne.NewPos(remainStart, top+m.top.MinSize().Height-theme.Padding()*4))
 	m.main.Resize(fyne.NewSize(remainWidth, m.main.MinSize().Height))
+	m.sending.Move(fyne.NewPos(remainStart, m.main.Position().Y+m.main.Size().Height-theme.Padding()*2))
+	m.sending.Resize(fyne.NewSize(remainWidth, m.sending.MinSize().Height))
 	m.sep.Move(fyne.NewPos(0, s.Height-theme.SeparatorThicknessSize()))
 	m.sep.Resize(fyne.NewSize(s.Width, theme.SeparatorThicknessSize()))
 }
@@ -92,24 +467,79 @@ func (m *messageRenderer) MinSize() fyne.Size {
 	s1 := m.top.MinSize()
 	s2 := m.main.MinSize()
 	w := fyne.Max(s1.Width, s2.Width)
-	return fyne.NewSize(w+iconSize+theme.Padding()*2,
-		s1.Height+s2.Height-theme.Padding()*4)
+	h := m.dividerHeight() + s1.Height + s2.Height - theme.Padding()*4
+	if m.sending.Visible() {
+		s3 := m.sending.MinSize()
+		w = fyne.Max(w, s3.Width)
+		h += s3.Height - theme.Padding()*2
+	}
+	return fyne.NewSize(w+iconSize+theme.Padding()*2, h)
 }
 
 func (m *messageRenderer) Objects() []fyne.CanvasObject {
-	return []fyne.CanvasObject{m.top, m.main, m.pic, m.sep}
+	return []fyne.CanvasObject{m.dividerLine, m.divider, m.top, m.main, m.pic, m.sep, m.sending, m.picTap,
+		m.nameTap}
+}
+
+func (m *messageRenderer) dividerHeight() float32 {
+	if !m.m.unreadDivider {
+		return 0
+	}
+	return m.divider.MinSize().Height
 }
 
 func (m *messageRenderer) Refresh() {
-	if m.m.msg.user == nil {
-		m.top.SetText("(Unknown)")
+	m.divider.Hidden = !m.m.unreadDivider
+	m.divider.Color = theme.ErrorColor()
+	m.divider.Refresh()
+	m.dividerLine.Hidden = m.divider.Hidden
+	m.dividerLine.FillColor = theme.ErrorColor()
+	m.dividerLine.Refresh()
+
+	title := m.m.msg.authorName()
+	if m.m.showSource && m.m.msg.channel != nil {
+		title += " · " + m.m.msg.channel.sourceName()
+	}
+	if m.m.msg.pinned {
+		title += " 📌"
+	}
+	m.top.SetText(title)
+	if m.m.msg.system { // events from the service are shown dimmed so they stand apart from what people wrote
+		m.main.Segments = []widget.RichTextSegment{&widget.TextSegment{Text: m.m.msg.content,
+			Style: widget.RichTextStyle{ColorName: theme.ColorNamePlaceHolder, TextStyle: fyne.TextStyle{Italic: true}}}}
+		m.main.Refresh()
+	} else if rich := m.m.msg.rich; rich != nil {
+		m.main.Segments = richSegments(rich, m.m.openChannel, m.m.openFile, m.m.reveal)
+		m.main.Refresh()
 	} else {
-		if m.m.msg.user.name != "" {
-			m.top.SetText(m.m.msg.user.name)
-		} else {
-			m.top.SetText(m.m.msg.user.username)
+		m.main.ParseMarkdown(m.m.msg.content)
+	}
+	m.refreshSending()
+	m.Layout(m.m.Size())
+
+	msg := m.m.msg
+	m.pic.SetResource(nil)
+	go func() {
+		res := msg.user.avatar()
+		if m.m.msg == msg { // the cell may have been reused while we loaded
+			m.pic.SetResource(res)
 		}
+	}()
+}
+
+func (m *messageRenderer) refreshSending() {
+	out := m.m.msg.outgoing
+	if out == nil {
+		m.sending.Hide()
+		return
+	}
+
+	if out.failed() {
+		m.status.SetText("Failed to send")
+		m.retry.Show()
+	} else {
+		m.status.SetText("Sending…")
+		m.retry.Hide()
 	}
-	m.main.ParseMarkdown(m.m.msg.content)
-	go m.pic.SetResource(m.m.avatarResource())
+	m.sending.Show()
 }
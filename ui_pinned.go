@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	pinnedHeight = 400
+	pinnedWidth  = 360
+)
+
+// showPinned pops up the messages pinned in the current channel at the top of the message list.
+// They are loaded from the service each time, as other people may have pinned something.
+func (u *ui) showPinned() {
+	ch := u.currentChannel
+	if ch == nil || ch.server.service == nil {
+		return
+	}
+
+	title := widget.NewLabelWithStyle("Pinned in "+ch.name, fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	items := container.NewVBox(widget.NewLabel("Loading…"))
+	scroll := container.NewVScroll(items)
+	scroll.SetMinSize(fyne.NewSize(pinnedWidth, pinnedHeight))
+	pop := widget.NewPopUp(container.NewBorder(title, nil, nil, nil, scroll), u.win.Canvas())
+	pos := fyne.CurrentApp().Driver().AbsolutePositionForObject(u.messages.content)
+	pop.ShowAtPosition(pos.AddXY(u.messages.content.Size().Width-pinnedWidth, 0))
+
+	go func() {
+		list, err := ch.server.service.pinned(ch)
+		if err != nil {
+			fyne.LogError("Failed to load pinned messages of "+ch.name, err)
+			items.Objects = []fyne.CanvasObject{widget.NewLabel("Could not load pinned messages")}
+			items.Refresh()
+			return
+		}
+
+		items.Objects = nil
+		for _, m := range list {
+			m.channel = ch
+			items.Add(u.pinnedItem(m, pop))
+		}
+		if len(list) == 0 {
+			items.Add(widget.NewLabel("Nothing is pinned here yet"))
+		}
+		items.Refresh()
+	}()
+}
+
+// pinnedItem shows a pinned message with buttons to jump to it in the channel or to unpin it.
+func (u *ui) pinnedItem(m *message, pop *widget.PopUp) fyne.CanvasObject {
+	author := widget.NewLabelWithStyle(m.authorName(), fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	author.Truncation = fyne.TextTruncateEllipsis
+	sent := widget.NewLabel(m.sent.Format("2 Jan 2006 15:04"))
+	sent.Importance = widget.LowImportance
+	text := m.content
+	if m.rich != nil {
+		text = plainText(m.rich)
+	}
+	body := widget.NewLabel(text)
+	body.Wrapping = fyne.TextWrapWord
+
+	jump := widget.NewButtonWithIcon("Jump", theme.NavigateNextIcon(), func() {
+		pop.Hide()
+		u.jumpTo(m)
+	})
+	var unpin *widget.Button
+	unpin = widget.NewButtonWithIcon("Unpin", theme.DeleteIcon(), func() {
+		unpin.Disable()
+		go func() {
+			if u.setPinned(m, false) {
+				unpin.SetText("Unpinned")
+			} else {
+				unpin.Enable()
+			}
+		}()
+	})
+	jump.Importance = widget.LowImportance
+	unpin.Importance = widget.LowImportance
+
+	return container.NewVBox(container.NewBorder(nil, nil, nil, sent, author), body,
+		container.NewHBox(jump, unpin), widget.NewSeparator())
+}
+
+// jumpTo shows m in its channel, if it is among the messages loaded.
+func (u *ui) jumpTo(m *message) {
+	if u.currentChannel != m.channel {
+		u.openChannel(m.channel)
+	}
+	if !u.messages.scrollTo(m.id) {
+		dialog.ShowInformation("Message not loaded",
+			"This message is older than those loaded for "+m.channel.name+".", u.win)
+	}
+}
+
+// showMessageMenu shows the actions for m at pos.
+func (u *ui) showMessageMenu(m *message, pos fyne.Position) {
+	if m.system || m.outgoing != nil || m.channel == nil || m.channel.server.service == nil {
+		return
+	}
+
+	pin := fyne.NewMenuItem("Pin message", func() {
+		go u.setPinned(m, true)
+	})
+	if m.pinned {
+		pin = fyne.NewMenuItem("Unpin message", func() {
+			go u.setPinned(m, false)
+		})
+	}
+	widget.ShowPopUpMenuAtPosition(fyne.NewMenu("", pin), u.win.Canvas(), pos)
+}
+
+// setPinned asks the service to pin or unpin m, marking the copy in its channel to match.
+// It returns false if the service failed, after telling the user.
+func (u *ui) setPinned(m *message, on bool) bool {
+	if err := m.channel.server.service.setPinned(m, on); err != nil {
+		dialog.ShowError(err, u.win)
+		return false
+	}
+
+	m.pinned = on
+	for _, c := range m.channel.messages {
+		if c.id == m.id {
+			c.pinned = on
+		}
+	}
+	if m.channel == u.currentChannel || u.showingInbox() {
+		u.refreshMessages()
+	}
+	return true
+}
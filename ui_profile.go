@@ -0,0 +1,128 @@
+package main
+
+import (
+	"image/color"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	profileAvatarSize = 80
+	profileWidth      = 300
+)
+
+// tapTarget is an invisible area over part of a widget that calls onTapped when it is tapped.
+type tapTarget struct {
+	widget.BaseWidget
+	onTapped func(*fyne.PointEvent)
+}
+
+func newTapTarget(onTapped func(*fyne.PointEvent)) *tapTarget {
+	t := &tapTarget{onTapped: onTapped}
+	t.ExtendBaseWidget(t)
+	return t
+}
+
+func (t *tapTarget) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(canvas.NewRectangle(color.Transparent))
+}
+
+func (t *tapTarget) Cursor() desktop.Cursor {
+	return desktop.PointerCursor
+}
+
+func (t *tapTarget) Tapped(ev *fyne.PointEvent) {
+	if t.onTapped != nil {
+		t.onTapped(ev)
+	}
+}
+
+// showProfile pops up what we know about usr on srv at pos, with a button to message them.
+// The bio is loaded from the service while the card is showing.
+func (u *ui) showProfile(usr *user, srv *server, roles []string, pos fyne.Position) {
+	if usr == nil || srv == nil {
+		return
+	}
+
+	pic := canvas.NewImageFromResource(theme.AccountIcon())
+	pic.FillMode = canvas.ImageFillContain
+	pic.SetMinSize(fyne.NewSize(profileAvatarSize, profileAvatarSize))
+	go func() {
+		if res := usr.avatar(); res != nil {
+			pic.Resource = res
+			pic.Refresh()
+		}
+	}()
+
+	name := widget.NewLabelWithStyle(usr.displayName(), fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	name.Truncation = fyne.TextTruncateEllipsis
+	username := widget.NewLabel(usr.username)
+	username.Importance = widget.LowImportance
+	if usr.username == "" || usr.username == usr.displayName() {
+		username.Hide()
+	}
+	dot := canvas.NewCircle(presenceColor(usr.presence))
+	status := container.NewHBox(container.NewCenter(
+		container.NewGridWrap(fyne.NewSize(presenceDotSize, presenceDotSize), dot)),
+		widget.NewLabel(presenceName(usr.presence)))
+
+	account := srv.name
+	if srv.account != "" {
+		account += " (" + srv.account + ")"
+	}
+	details := widget.NewForm(widget.NewFormItem("Service",
+		container.NewHBox(widget.NewIcon(srv.icon()), widget.NewLabel(account))))
+	if len(roles) > 0 {
+		list := widget.NewLabel(strings.Join(roles, ", "))
+		list.Wrapping = fyne.TextWrapWord
+		details.Append("Roles", list)
+	}
+	bio := widget.NewLabel("Loading…")
+	bio.Wrapping = fyne.TextWrapWord
+	bio.Importance = widget.LowImportance
+	details.Append("About", bio)
+
+	var pop *widget.PopUp
+	message := widget.NewButtonWithIcon("Message", theme.MailComposeIcon(), func() {
+		pop.Hide()
+		go u.openDirect(usr, srv)
+	})
+	message.Importance = widget.HighImportance
+	if srv.service == nil {
+		message.Disable()
+		bio.SetText("")
+	} else {
+		go func() {
+			text, err := srv.service.bio(usr)
+			if err != nil {
+				fyne.LogError("Failed to load profile of "+usr.displayName(), err)
+			}
+			if text == "" {
+				text = "Nothing shared"
+			}
+			bio.SetText(text)
+		}()
+	}
+
+	header := container.NewBorder(nil, nil, pic, nil, container.NewVBox(name, username, status))
+	pop = widget.NewPopUp(container.NewVBox(header, details, message), u.win.Canvas())
+	pop.Resize(fyne.NewSize(profileWidth, pop.MinSize().Height))
+	pop.ShowAtPosition(pos)
+}
+
+// openDirect opens the direct conversation with usr on srv, asking the service to create it if needed.
+func (u *ui) openDirect(usr *user, srv *server) {
+	ch, err := srv.service.directChannel(usr)
+	if err != nil {
+		dialog.ShowError(err, u.win)
+		return
+	}
+	u.showNewChannel(ch)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	searchAllAccounts = "All accounts"
+	searchDateFormat  = "2006-01-02"
+)
+
+func (u *ui) makeSearchEntry() fyne.CanvasObject {
+	search := widget.NewEntry()
+	search.SetPlaceHolder("Search")
+	search.ActionItem = widget.NewIcon(theme.SearchIcon())
+	search.OnSubmitted = func(text string) {
+		u.showSearch(text)
+		search.SetText("")
+	}
+	return search
+}
+
+// showSearch opens the search panel, looking for text in all messages we have seen.
+func (u *ui) showSearch(text string) {
+	logins, labels := u.loginLabels()
+	accounts := widget.NewSelect(append([]string{searchAllAccounts}, labels...), nil)
+	accounts.SetSelected(searchAllAccounts)
+	query := widget.NewEntry()
+	query.SetText(text)
+	channelName := widget.NewEntry()
+	channelName.SetPlaceHolder("Any channel")
+	author := widget.NewEntry()
+	author.SetPlaceHolder("Anyone")
+	from := widget.NewEntry()
+	from.SetPlaceHolder(searchDateFormat)
+	to := widget.NewEntry()
+	to.SetPlaceHolder(searchDateFormat)
+
+	var lock sync.Mutex // guards results and searches, which the search goroutine updates
+	var results []*searchResult
+	searches := 0
+	result := func(id widget.ListItemID) *searchResult {
+		lock.Lock()
+		defer lock.Unlock()
+		return results[id]
+	}
+	setResults := func(list []*searchResult, current int) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if current != searches { // the user started another search while we waited
+			return false
+		}
+		results = list
+		return true
+	}
+
+	status := widget.NewLabel("")
+	list := widget.NewList(
+		func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(results)
+		},
+		func() fyne.CanvasObject {
+			title := widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+			title.Truncation = fyne.TextTruncateEllipsis
+			body := widget.NewLabel("")
+			body.Truncation = fyne.TextTruncateEllipsis
+			return container.NewVBox(title, body)
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			r := result(id)
+			rows := o.(*fyne.Container).Objects
+			rows[0].(*widget.Label).SetText(r.author + " in " + r.channelName + " · " + u.loginLabel(r.login) +
+				" · " + r.sent.Format("2 Jan 2006 15:04"))
+			rows[1].(*widget.Label).SetText(strings.ReplaceAll(r.snippet, "\n", " "))
+		})
+
+	var d dialog.Dialog
+	list.OnSelected = func(id widget.ListItemID) {
+		list.Unselect(id)
+		d.Hide()
+		u.showResult(result(id))
+	}
+
+	run := func() {
+		q := searchQuery{text: query.Text, channel: channelName.Text, author: author.Text}
+		if i := accounts.SelectedIndex(); i > 0 {
+			q.login = logins[i-1]
+		}
+		var err error
+		q.from, err = parseSearchDate(from.Text, false)
+		if err == nil {
+			q.to, err = parseSearchDate(to.Text, true)
+		}
+		if err != nil {
+			dialog.ShowError(err, u.win)
+			return
+		}
+
+		lock.Lock()
+		searches++
+		current := searches
+		lock.Unlock()
+		status.SetText("Searching…")
+		go func() {
+			if u.data != nil {
+				u.search.update(u.data.servers)
+			}
+			local, err := u.search.find(q)
+			if err != nil {
+				fyne.LogError("Search failed", err)
+				status.SetText("Search failed")
+				return
+			}
+
+			if !setResults(local, current) {
+				return
+			}
+			list.Refresh()
+			status.SetText(resultCount(len(local)) + ", searching servers…")
+
+			merged := mergeResults(local, u.searchRemote(q))
+			if !setResults(merged, current) {
+				return
+			}
+			list.Refresh()
+			status.SetText(resultCount(len(merged)))
+		}()
+	}
+	query.OnSubmitted = func(string) {
+		run()
+	}
+
+	form := widget.NewForm(
+		widget.NewFormItem("Search for", query),
+		widget.NewFormItem("Account", accounts),
+		widget.NewFormItem("Channel", channelName),
+		widget.NewFormItem("Author", author),
+		widget.NewFormItem("Sent after", from),
+		widget.NewFormItem("Sent before", to))
+	button := widget.NewButtonWithIcon("Search", theme.SearchIcon(), run)
+	button.Importance = widget.HighImportance
+	top := container.NewVBox(form, container.NewBorder(nil, nil, nil, button, status))
+
+	d = dialog.NewCustom("Search messages", "Close", container.NewBorder(top, nil, nil, nil, list), u.win)
+	d.Resize(fyne.NewSize(560, 520))
+	d.Show()
+	if text != "" {
+		run()
+	}
+}
+
+// showResult switches to the channel a search result was found in and scrolls to the message.
+func (u *ui) showResult(r *searchResult) {
+	if u.data == nil {
+		return
+	}
+
+	for _, srv := range u.data.servers {
+		if srv.login != r.login || srv.id != r.server {
+			continue
+		}
+
+		if ch := findKey(srv, channelKey(srv.id, r.channel, r.direct)); ch != nil {
+			u.openChannel(ch)
+			if !u.messages.scrollTo(r.msgID) {
+				u.showResultContent(r, "This message is older than the history loaded for "+ch.name+".")
+			}
+			return
+		}
+	}
+
+	u.showResultContent(r, "The channel "+r.channelName+" is not currently available.")
+}
+
+// showResultContent displays a message that we cannot show in its channel, along with the reason why.
+func (u *ui) showResultContent(r *searchResult, reason string) {
+	if r.content == "" {
+		dialog.ShowInformation("Search", reason, u.win)
+		return
+	}
+
+	title := widget.NewLabelWithStyle(r.author+" in "+r.channelName+" · "+r.sent.Format("2 Jan 2006 15:04"),
+		fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	body := widget.NewLabel(r.content)
+	body.Wrapping = fyne.TextWrapWord
+	note := widget.NewLabelWithStyle(reason, fyne.TextAlignLeading, fyne.TextStyle{Italic: true})
+	d := dialog.NewCustom("Search", "Close", container.NewVBox(title, body, note), u.win)
+	d.Resize(fyne.NewSize(400, 0))
+	d.Show()
+}
+
+// searchRemote asks each online service to search its server, filtering the results to match the query.
+// Services that cannot search, or fail, simply add nothing to the results from our index.
+func (u *ui) searchRemote(q searchQuery) []*searchResult {
+	if u.data == nil {
+		return nil
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var results []*searchResult
+	seen := make(map[service]bool)
+	for _, srv := range u.data.servers {
+		if seen[srv.service] || (q.login != "" && srv.login != q.login) {
+			continue
+		}
+		seen[srv.service] = true
+		if srv.status != nil && srv.status.currentState() != stateOnline {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s service) {
+			defer wg.Done()
+			found, err := s.search(q)
+			if err != nil {
+				fyne.LogError("Server search failed", err)
+			}
+
+			lock.Lock()
+			results = append(results, found...)
+			lock.Unlock()
+		}(srv.service)
+	}
+	wg.Wait()
+	return results
+}
+
+func resultCount(n int) string {
+	switch n {
+	case 0:
+		return "No messages found"
+	case 1:
+		return "1 message found"
+	}
+	return strconv.Itoa(n) + " messages found"
+}
+
+// loginLabels returns the preference prefix of each login and a matching label to show the user.
+func (u *ui) loginLabels() (logins, labels []string) {
+	if u.data == nil {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, srv := range u.data.servers {
+		if seen[srv.login] {
+			continue
+		}
+		seen[srv.login] = true
+		logins = append(logins, srv.login)
+	}
+	sort.Strings(logins)
+
+	for _, login := range logins {
+		labels = append(labels, u.loginLabel(login))
+	}
+	return logins, labels
+}
+
+// loginLabel describes the login stored at the preference prefix, such as "Telegram: Work".
+func (u *ui) loginLabel(login string) string {
+	kind := fyne.CurrentApp().Preferences().String(login + prefServerTypeKey)
+	if r, size := utf8.DecodeRuneInString(kind); size > 0 {
+		kind = string(unicode.ToUpper(r)) + kind[size:]
+	}
+	if u.data != nil {
+		for _, srv := range u.data.servers {
+			if srv.login == login && srv.account != "" {
+				return kind + ": " + srv.account
+			}
+		}
+	}
+	return kind
+}
+
+// parseSearchDate reads a date typed by the user, end dates include the whole day.
+func parseSearchDate(text string, end bool) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return time.Time{}, nil
+	}
+
+	day, err := time.ParseInLocation(searchDateFormat, text, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("dates should be in the format YYYY-MM-DD")
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
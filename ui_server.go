@@ -0,0 +1,166 @@
+package main
+
+import (
+	"image/color"
+	"strings"
+	"unicode"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const statusSize = float32(10)
+
+type serverCell struct {
+	widget.BaseWidget
+	srv         *server
+	showAccount bool
+}
+
+func newServerCell() *serverCell {
+	ret := &serverCell{}
+	ret.ExtendBaseWidget(ret)
+	return ret
+}
+
+// setServer updates the cell to show srv, or the add icon if srv is nil.
+// If showAccount is true the account initials are drawn over the icon so that
+// multiple logins to the same service can be told apart.
+func (s *serverCell) setServer(srv *server, showAccount bool) {
+	s.srv = srv
+	s.showAccount = showAccount
+	s.Refresh()
+}
+
+func (s *serverCell) CreateRenderer() fyne.WidgetRenderer {
+	img := &canvas.Image{}
+	badge := canvas.NewText("", theme.ForegroundColor())
+	badge.TextSize = theme.CaptionTextSize()
+	badge.TextStyle.Bold = true
+	bg := canvas.NewRectangle(theme.OverlayBackgroundColor())
+	bg.CornerRadius = theme.InputRadiusSize()
+
+	status := canvas.NewCircle(color.Transparent)
+	status.StrokeColor = theme.BackgroundColor()
+	status.StrokeWidth = 1.5
+
+	return &serverRenderer{s: s, img: img, badge: badge, badgeBG: bg, status: status}
+}
+
+type serverRenderer struct {
+	s       *serverCell
+	img     *canvas.Image
+	badge   *canvas.Text
+	badgeBG *canvas.Rectangle
+	status  *canvas.Circle
+}
+
+func (s *serverRenderer) Destroy() {
+}
+
+func (s *serverRenderer) Layout(size fyne.Size) {
+	s.img.Resize(size)
+
+	badgeSize := s.badge.MinSize().Add(fyne.NewSize(theme.InnerPadding()/2, 0))
+	badgePos := fyne.NewPos(size.Width-badgeSize.Width, size.Height-badgeSize.Height)
+	s.badgeBG.Resize(badgeSize)
+	s.badgeBG.Move(badgePos)
+	s.badge.Resize(s.badge.MinSize())
+	s.badge.Move(badgePos.Add(fyne.NewPos(theme.InnerPadding()/4, 0)))
+
+	s.status.Resize(fyne.NewSize(statusSize, statusSize))
+	s.status.Move(fyne.NewPos(size.Width-statusSize, 0))
+}
+
+func (s *serverRenderer) MinSize() fyne.Size {
+	return fyne.NewSize(theme.IconInlineSize()*2, theme.IconInlineSize()*2)
+}
+
+func (s *serverRenderer) Objects() []fyne.CanvasObject {
+	return []fyne.CanvasObject{s.img, s.badgeBG, s.badge, s.status}
+}
+
+func (s *serverRenderer) Refresh() {
+	srv := s.s.srv
+	if srv == nil {
+		s.img.Resource = theme.ContentAddIcon()
+	} else {
+		s.img.Resource = srv.icon()
+	}
+	s.img.Refresh()
+
+	s.badge.Text = ""
+	if srv != nil && s.s.showAccount {
+		s.badge.Text = accountInitials(srv.account)
+	}
+	s.badge.Color = theme.ForegroundColor()
+	s.badge.Hidden = s.badge.Text == ""
+	s.badge.Refresh()
+	s.badgeBG.FillColor = theme.OverlayBackgroundColor()
+	s.badgeBG.Hidden = s.badge.Hidden
+	s.badgeBG.Refresh()
+
+	s.status.Hidden = srv == nil || srv.status == nil
+	if !s.status.Hidden {
+		s.status.FillColor = statusColor(srv.status.currentState())
+		s.status.StrokeColor = theme.BackgroundColor()
+	}
+	s.status.Refresh()
+
+	s.Layout(s.s.Size())
+}
+
+// showStatus tells the user if the login for a server needs attention, offering to retry if it went offline.
+func (u *ui) showStatus(s *server) {
+	if s.status == nil {
+		return
+	}
+
+	name := s.name
+	if s.account != "" {
+		name += " (" + s.account + ")"
+	}
+	switch s.status.currentState() {
+	case stateAuthRequired:
+		dialog.ShowInformation("Login required",
+			"The login for "+name+" is no longer valid.\nPlease add the account again.", u.win)
+	case stateFailed:
+		dialog.ShowConfirm("Offline", name+" could not connect.\nTry again now?", func(ok bool) {
+			if ok {
+				s.status.retry()
+			}
+		}, u.win)
+	}
+}
+
+func statusColor(s connState) color.Color {
+	switch s {
+	case stateOnline:
+		return theme.SuccessColor()
+	case stateReconnecting:
+		return theme.WarningColor()
+	case stateAuthRequired, stateFailed:
+		return theme.ErrorColor()
+	}
+	return theme.DisabledColor()
+}
+
+// accountInitials returns up to two upper case initials for an account name.
+func accountInitials(name string) string {
+	var initials []rune
+	for _, word := range strings.Fields(name) {
+		r := []rune(word)[0]
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			continue
+		}
+
+		initials = append(initials, unicode.ToUpper(r))
+		if len(initials) == 2 {
+			break
+		}
+	}
+	return string(initials)
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +20,7 @@ import (
 	"fyne.io/fyne/v2/widget"
 
 	"github.com/Rhymen/go-whatsapp"
+	"github.com/Rhymen/go-whatsapp/binary/proto"
 	"github.com/skip2/go-qrcode"
 )
 
@@ -24,11 +30,22 @@ const (
 	prefWhatsClientIDKey    = "sess.client"
 	prefWhatsClientTokenKey = "sess.token"
 	prefWhatsServerTokenKey = "sess.server"
+
+	whatsAppResyncCount = 20
+	whatsAppSearchCount = 50
+)
+
+var (
+	whatsAppMarkup = []markupDelim{{"```", richCodeBlock, false}, {"```", richCode, false}, {"*", richBold, true},
+		{"_", richItalic, true}, {"~", richStrike, true}}
+	whatsAppMention = regexp.MustCompile(`@(\d{5,})`)
 )
 
 type whatsApp struct {
 	app    fyne.App
 	conn   *whatsapp.Conn
+	status *connection
+	loaded bool
 	server *server
 	ui     *ui
 }
@@ -37,6 +54,24 @@ func initWhatsApp(a fyne.App) service {
 	return &whatsApp{app: a}
 }
 
+// bio loads the status text that the user has set on their profile.
+func (w *whatsApp) bio(usr *user) (string, error) {
+	data, err := w.conn.GetStatus(usr.id)
+	if err != nil {
+		return "", err
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	err = json.NewDecoder(strings.NewReader(<-data)).Decode(&status)
+	return status.Status, err
+}
+
+// commands returns nothing as WhatsApp only has the built in commands.
+func (w *whatsApp) commands() []*command {
+	return nil
+}
+
 func (w *whatsApp) configure(u *ui) (fyne.CanvasObject, func(prefix string, a fyne.App)) {
 	w.conn = w.setupClient(60)
 
@@ -57,71 +92,207 @@ func (w *whatsApp) configure(u *ui) (fyne.CanvasObject, func(prefix string, a fy
 			return
 		}
 
-		encStr := base64.StdEncoding.EncodeToString(sess.EncKey)
-		macStr := base64.StdEncoding.EncodeToString(sess.MacKey)
 		qrScreen.Hide()
-		a.Preferences().SetString(prefix+prefWhatsEncKeyKey, encStr)
-		a.Preferences().SetString(prefix+prefWhatsMacKeyKey, macStr)
-		a.Preferences().SetString(prefix+prefWhatsClientIDKey, sess.ClientId)
-		a.Preferences().SetString(prefix+prefWhatsClientTokenKey, sess.ClientToken)
-		a.Preferences().SetString(prefix+prefWhatsServerTokenKey, sess.ServerToken)
+		w.saveSession(sess, prefix, a.Preferences())
 		w.login(prefix, u)
 	}
 }
 
 func (w *whatsApp) disconnect() {
+	if w.status != nil {
+		w.status.close()
+	}
 	_, _ = w.conn.Disconnect()
 }
 
+// emojis returns nothing as WhatsApp has no custom emoji.
+func (w *whatsApp) emojis(*server) ([]*customEmoji, error) {
+	return nil, nil
+}
+
 func (w *whatsApp) login(prefix string, u *ui) {
 	w.ui = u
+	w.status = newConnection(u.connectionChanged)
 	if w.conn == nil {
 		w.conn = w.setupClient(5)
+	}
+
+	srv := &server{service: w, name: "WhatsApp", login: prefix, iconResource: resourceWhatsappPng, status: w.status}
+	srv.account = accountName(w.app, prefix, "")
+	srv.users = make(map[string]*user)
+	w.server = srv
+	u.addServers(srv)
+
+	w.status.reconnect(func() error {
+		return w.connect(prefix)
+	})
+}
 
-		p := w.app.Preferences()
-		encBytes, _ := base64.StdEncoding.DecodeString(p.String(prefix + prefWhatsEncKeyKey))
-		macBytes, _ := base64.StdEncoding.DecodeString(p.String(prefix + prefWhatsMacKeyKey))
-		load := whatsapp.Session{
-			EncKey:      encBytes,
-			MacKey:      macBytes,
-			ClientId:    p.String(prefix + prefWhatsClientIDKey),
-			ClientToken: p.String(prefix + prefWhatsClientTokenKey),
-			ServerToken: p.String(prefix + prefWhatsServerTokenKey)}
-		_, err := w.conn.RestoreWithSession(load)
+// connect restores the saved session if we are not logged in, catching up on messages if it had dropped.
+// It is used as the dial function for our connection status so may be called many times.
+func (w *whatsApp) connect(prefix string) error {
+	p := w.app.Preferences()
+	if !w.conn.GetLoggedIn() {
+		sess, err := w.conn.RestoreWithSession(w.loadSession(prefix, p))
 		if err != nil {
 			log.Println("Failed to recover WhatsApp session", err)
-			return
+			return whatsAppError(err)
 		}
+		w.saveSession(sess, prefix, p)
 	}
+	w.server.account = accountName(w.app, prefix, w.conn.Info.Pushname)
 
-	srv := &server{service: w, name: "WhatsApp", iconResource: resourceWhatsappPng}
-	srv.users = make(map[string]*user)
-	w.server = srv
+	if w.loaded {
+		go w.resync()
+		return nil
+	}
+	w.loaded = true
+	w.conn.AddHandler(w)
+	return nil
+}
+
+func (w *whatsApp) loadSession(prefix string, p fyne.Preferences) whatsapp.Session {
+	encBytes, _ := base64.StdEncoding.DecodeString(p.String(prefix + prefWhatsEncKeyKey))
+	macBytes, _ := base64.StdEncoding.DecodeString(p.String(prefix + prefWhatsMacKeyKey))
+	return whatsapp.Session{
+		EncKey:      encBytes,
+		MacKey:      macBytes,
+		ClientId:    p.String(prefix + prefWhatsClientIDKey),
+		ClientToken: p.String(prefix + prefWhatsClientTokenKey),
+		ServerToken: p.String(prefix + prefWhatsServerTokenKey)}
+}
 
-	if u.data == nil {
-		u.data = &appData{}
+// resync asks for the latest messages in each chat, the handler will add any we missed while offline.
+func (w *whatsApp) resync() {
+	for _, c := range w.server.channels {
+		err := w.conn.LoadChatMessages(c.id, whatsAppResyncCount, "", false, false)
+		if err != nil {
+			log.Println("Failed to load missed messages", err)
+		}
 	}
-	u.data.servers = append(u.data.servers, srv)
-	if len(u.data.servers) > 0 {
-		u.currentServer = u.data.servers[0]
-		u.servers.Select(0)
+}
+
+// saveSession stores the session tokens, they change each time we log in.
+func (w *whatsApp) saveSession(sess whatsapp.Session, prefix string, p fyne.Preferences) {
+	encStr := base64.StdEncoding.EncodeToString(sess.EncKey)
+	macStr := base64.StdEncoding.EncodeToString(sess.MacKey)
+	p.SetString(prefix+prefWhatsEncKeyKey, encStr)
+	p.SetString(prefix+prefWhatsMacKeyKey, macStr)
+	p.SetString(prefix+prefWhatsClientIDKey, sess.ClientId)
+	p.SetString(prefix+prefWhatsClientTokenKey, sess.ClientToken)
+	p.SetString(prefix+prefWhatsServerTokenKey, sess.ServerToken)
+}
+
+// search asks the phone to look through its messages, it only matches text and so other filters are applied here.
+func (w *whatsApp) search(q searchQuery) ([]*searchResult, error) {
+	if q.text == "" {
+		return nil, nil
 	}
-	u.servers.Refresh()
 
-	w.conn.AddHandler(w)
+	node, err := w.conn.Search(q.text, whatsAppSearchCount, 1)
+	if err != nil {
+		return nil, err
+	}
+	content, ok := node.Content.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	var results []*searchResult
+	for _, item := range content {
+		info, ok := item.(*proto.WebMessageInfo)
+		if !ok {
+			continue
+		}
+		m, ok := whatsapp.ParseProtoMessage(info).(whatsapp.TextMessage)
+		if !ok {
+			continue
+		}
+
+		name := m.Info.RemoteJid
+		if ch := findServerChan(w.server, m.Info.RemoteJid); ch != nil {
+			name = ch.name
+		}
+		r := &searchResult{login: w.server.login, server: w.server.id, channel: m.Info.RemoteJid, msgID: m.Info.Id,
+			channelName: name, author: w.getUser(w.sender(m.Info)).name, snippet: m.Text, content: m.Text,
+			sent: time.Unix(int64(m.Info.Timestamp), 0), direct: !strings.HasSuffix(m.Info.RemoteJid, "@g.us"),
+			remote: true}
+		if q.matches(r) {
+			results = append(results, r)
+		}
+	}
+	return results, nil
 }
 
-func (w *whatsApp) send(ch *channel, text string) {
-	_, err := w.conn.Send(whatsapp.TextMessage{Text: text, Info: whatsapp.MessageInfo{
-		RemoteJid: ch.id}})
+// directChannel returns the chat with usr, adding it to our list if we have not talked before.
+func (w *whatsApp) directChannel(usr *user) (*channel, error) {
+	if ch := findServerChan(w.server, usr.id); ch != nil {
+		return ch, nil
+	}
+
+	ch := &channel{id: usr.id, name: usr.displayName(), direct: true, category: directSection, server: w.server}
+	migrateChannelKey(ch)
+	w.server.channels = append(w.server.channels, ch)
+	return ch, nil
+}
+
+// members lists the participants of a group, or both people in a direct chat.
+func (w *whatsApp) members(ch *channel) ([]*member, error) {
+	if ch.direct {
+		return []*member{{user: w.getUser(ch.id)}, {user: w.getUser(w.conn.Info.Wid)}}, nil
+	}
+
+	data, err := w.conn.GetGroupMetaData(ch.id)
 	if err != nil {
-		log.Println("Error sending", err)
-		return
+		return nil, err
+	}
+	var meta struct {
+		Participants []struct {
+			ID         string `json:"id"`
+			Admin      bool   `json:"isAdmin"`
+			SuperAdmin bool   `json:"isSuperAdmin"`
+		} `json:"participants"`
+	}
+	err = json.NewDecoder(strings.NewReader(<-data)).Decode(&meta)
+	if err != nil {
+		return nil, err
 	}
 
-	msg := &message{content: text, user: w.getUser(w.conn.Info.Wid)}
-	ch.messages = append(ch.messages, msg)
-	w.ui.appendMessages([]*message{msg})
+	var list []*member
+	for _, p := range meta.Participants {
+		m := &member{user: w.getUser(strings.Replace(p.ID, "@c.us", "@s.whatsapp.net", 1))}
+		if p.SuperAdmin {
+			m.roles = []string{"Owner"}
+		} else if p.Admin {
+			m.roles = []string{"Admin"}
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+func (w *whatsApp) send(ch *channel, rich []richSpan) error {
+	var mentioned []string
+	text := formatMarkup(rich, whatsAppMarkup, markupTokens{
+		link: func(text, url string) string {
+			if text == url {
+				return url
+			}
+			return text + " (" + url + ")"
+		},
+		mention: func(id string) string {
+			mentioned = append(mentioned, id)
+			return "@" + strings.Split(id, "@")[0]
+		}})
+	id, err := w.conn.Send(whatsAppTextProto(ch.id, text, mentioned))
+	if err != nil {
+		return err
+	}
+
+	msg := &message{id: id, content: text, rich: w.richContent(text), sent: time.Now(),
+		user: w.getUser(w.conn.Info.Wid)}
+	w.ui.messagesAdded(ch, ch.appendNew([]*message{msg}))
+	return nil
 }
 
 func (w *whatsApp) setupClient(secs int) *whatsapp.Conn {
@@ -133,47 +304,283 @@ func (w *whatsApp) setupClient(secs int) *whatsapp.Conn {
 }
 
 func (w *whatsApp) HandleError(err error) {
+	switch err.(type) {
+	case *whatsapp.ErrConnectionFailed, *whatsapp.ErrConnectionClosed:
+		log.Println("WhatsApp connection lost", err)
+		w.status.dropped()
+		return
+	}
+
 	log.Println("WhatsApp error", err)
 }
 
 func (w *whatsApp) HandleTextMessage(m whatsapp.TextMessage) {
-	from := m.Info.RemoteJid
-	if m.Info.FromMe {
-		from = w.conn.Info.Wid
-	} else if m.Info.Source.Participant != nil {
-		from = *m.Info.Source.Participant
+	msg := &message{id: m.Info.Id, content: m.Text, rich: w.richContent(m.Text),
+		sent: time.Unix(int64(m.Info.Timestamp), 0), user: w.getUser(w.sender(m.Info)), mentioned: w.mentionsMe(m)}
+	ch := w.chat(m.Info.RemoteJid)
+	w.ui.messagesAdded(ch, ch.appendNew([]*message{msg}))
+}
+
+// HandleRawMessage looks for missed calls and group events, which WhatsApp reports as messages with no content.
+func (w *whatsApp) HandleRawMessage(m *proto.WebMessageInfo) {
+	jid := m.GetKey().GetRemoteJid()
+	text, call := w.stubText(m)
+	if text == "" {
+		return
 	}
-	msg := &message{content: m.Text, user: w.getUser(from)}
-	var ch *channel
-	for _, c := range w.server.channels {
-		if c.id == m.Info.RemoteJid {
-			ch = c
-			break
-		}
+
+	from := jid
+	if p := m.GetParticipant(); p != "" {
+		from = p
+	}
+	msg := &message{id: m.GetKey().GetId(), content: text, sent: time.Unix(int64(m.GetMessageTimestamp()), 0),
+		user: w.getUser(from), mentioned: call, system: true}
+	known := findServerChan(w.server, jid) != nil
+	ch := w.chat(jid)
+	if !known {
+		w.ui.channels.Refresh()
 	}
-	if ch == nil {
-		ch = &channel{id: m.Info.RemoteJid, server: w.server}
-		w.server.channels = append(w.server.channels, ch)
-
-		data, err := w.conn.GetGroupMetaData(m.Info.RemoteJid)
-		if err == nil {
-			vals := make(map[string]interface{})
-			d := json.NewDecoder(strings.NewReader(<-data))
-			_ = d.Decode(&vals)
-			if name, ok := vals["subject"].(string); ok {
-				ch.name = name
-			} else {
-				ch.name = w.getUser(m.Info.RemoteJid).name
+	switch m.GetMessageStubType() {
+	case proto.WebMessageInfo_GROUP_PARTICIPANT_LEAVE, proto.WebMessageInfo_GROUP_PARTICIPANT_REMOVE:
+		for _, id := range m.GetMessageStubParameters() {
+			if strings.Split(id, "@")[0] == strings.Split(w.conn.Info.Wid, "@")[0] {
+				w.ui.removeChannel(ch)
+				return
 			}
+		}
+	}
+	if m.GetMessageStubType() == proto.WebMessageInfo_GROUP_CHANGE_SUBJECT && len(m.GetMessageStubParameters()) > 0 {
+		ch.name = m.GetMessageStubParameters()[0]
+		w.ui.channels.Refresh()
+	}
+	w.ui.messagesAdded(ch, ch.appendNew([]*message{msg}))
+}
+
+// stubText describes the event in a message without content, such as a missed call or someone joining a group.
+// It returns "" for events we do not show, and true if it was a call that the user should be told about.
+func (w *whatsApp) stubText(m *proto.WebMessageInfo) (string, bool) {
+	params := m.GetMessageStubParameters()
+	names := func() string {
+		list := make([]string, len(params))
+		for i, id := range params {
+			list[i] = w.getUser(strings.Replace(id, "@c.us", "@s.whatsapp.net", 1)).displayName()
+		}
+		return strings.Join(list, ", ")
+	}
+
+	switch m.GetMessageStubType() {
+	case proto.WebMessageInfo_CALL_MISSED_VIDEO, proto.WebMessageInfo_CALL_MISSED_GROUP_VIDEO:
+		return callText(true, false, true, 0), true
+	case proto.WebMessageInfo_CALL_MISSED_VOICE, proto.WebMessageInfo_CALL_MISSED_GROUP_VOICE:
+		return callText(false, false, true, 0), true
+	case proto.WebMessageInfo_GROUP_CREATE:
+		return "created the group", false
+	case proto.WebMessageInfo_GROUP_CHANGE_SUBJECT:
+		if len(params) > 0 {
+			return "renamed the group to " + params[0], false
+		}
+		return "renamed the group", false
+	case proto.WebMessageInfo_GROUP_CHANGE_ICON:
+		return "changed the group photo", false
+	case proto.WebMessageInfo_GROUP_CHANGE_DESCRIPTION:
+		return "changed the group description", false
+	case proto.WebMessageInfo_GROUP_PARTICIPANT_ADD:
+		return "added " + names(), false
+	case proto.WebMessageInfo_GROUP_PARTICIPANT_REMOVE:
+		return "removed " + names(), false
+	case proto.WebMessageInfo_GROUP_PARTICIPANT_INVITE:
+		return "joined using an invite link", false
+	case proto.WebMessageInfo_GROUP_PARTICIPANT_LEAVE:
+		return "left", false
+	}
+	return "", false
+}
+
+// chat returns the channel for the chat with jid, adding it if this is the first message we have seen there.
+func (w *whatsApp) chat(jid string) *channel {
+	if ch := findServerChan(w.server, jid); ch != nil {
+		return ch
+	}
+
+	ch := &channel{id: jid, direct: !strings.HasSuffix(jid, "@g.us"), server: w.server}
+	ch.category = groupsSection
+	if ch.direct {
+		ch.category = directSection
+	}
+	migrateChannelKey(ch)
+	w.server.channels = append(w.server.channels, ch)
+
+	data, err := w.conn.GetGroupMetaData(jid)
+	if err == nil {
+		vals := make(map[string]interface{})
+		d := json.NewDecoder(strings.NewReader(<-data))
+		_ = d.Decode(&vals)
+		if name, ok := vals["subject"].(string); ok {
+			ch.name = name
 		} else {
-			log.Println("get channel title error", err)
+			ch.name = w.getUser(jid).name
+		}
+	} else {
+		log.Println("get channel title error", err)
+	}
+	return ch
+}
+
+// join accepts an invite to a group, given as a chat.whatsapp.com link or just the code.
+func (w *whatsApp) join(invite string) (*channel, error) {
+	jid, err := w.conn.GroupAcceptInviteCode(invite[strings.LastIndex(invite, "/")+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return w.chat(jid), nil
+}
+
+// createGroup starts a group called name with people.
+func (w *whatsApp) createGroup(name string, people []*user) (*channel, error) {
+	if name == "" {
+		return nil, errors.New("WhatsApp groups need a name")
+	}
+
+	var jids []string
+	for _, usr := range people {
+		if usr.id != w.conn.Info.Wid {
+			jids = append(jids, usr.id)
+		}
+	}
+	resp, err := w.conn.CreateGroup(name, jids)
+	if err != nil {
+		return nil, err
+	}
+	var created struct {
+		Status int    `json:"status"`
+		GID    string `json:"gid"`
+	}
+	if err = json.NewDecoder(strings.NewReader(<-resp)).Decode(&created); err != nil {
+		return nil, err
+	}
+	if created.Status != 200 {
+		return nil, fmt.Errorf("WhatsApp could not create the group (%d)", created.Status)
+	}
+
+	ch := w.chat(created.GID)
+	if ch.name == "" {
+		ch.name = name
+	}
+	return ch, nil
+}
+
+// leave removes us from a group.
+func (w *whatsApp) leave(ch *channel) error {
+	if ch.direct {
+		return errors.New("direct messages cannot be left")
+	}
+
+	resp, err := w.conn.LeaveGroup(ch.id)
+	if err != nil {
+		return err
+	}
+	var left struct {
+		Status int `json:"status"`
+	}
+	if err = json.NewDecoder(strings.NewReader(<-resp)).Decode(&left); err != nil {
+		return err
+	}
+	if left.Status != 200 {
+		return fmt.Errorf("WhatsApp could not leave the group (%d)", left.Status)
+	}
+	w.ui.removeChannel(ch)
+	return nil
+}
+
+// leaveServer refuses, the server of a WhatsApp login is the account itself rather than something joined.
+func (w *whatsApp) leaveServer(*server) error {
+	return errors.New("WhatsApp accounts cannot be left, leave their groups instead")
+}
+
+// history returns nothing more, the recent messages of every chat are loaded when we connect.
+func (w *whatsApp) history(*channel) ([]*message, error) {
+	return nil, nil
+}
+
+// pinned returns nothing as the WhatsApp library does not know about pinned messages.
+func (w *whatsApp) pinned(*channel) ([]*message, error) {
+	return nil, nil
+}
+
+// setPinned fails as the WhatsApp library cannot pin messages.
+func (w *whatsApp) setPinned(*message, bool) error {
+	return errors.New("pinning messages is not supported on WhatsApp")
+}
+
+// setChannelFlag does nothing as the WhatsApp library cannot change chat settings, they are only kept locally.
+func (w *whatsApp) setChannelFlag(*channel, channelFlag, bool) error {
+	return nil
+}
+
+// sender returns the id of the user who wrote a message, in a group this is not the chat id.
+func (w *whatsApp) sender(info whatsapp.MessageInfo) string {
+	if info.FromMe {
+		return w.conn.Info.Wid
+	} else if info.Source.Participant != nil {
+		return *info.Source.Participant
+	}
+	return info.RemoteJid
+}
+
+// richContent converts WhatsApp formatting into rich text, showing @number mentions with the contact name.
+func (w *whatsApp) richContent(text string) []richSpan {
+	spans := linkURLs(parseMarkup(text, whatsAppMarkup, 0))
+	return expandTokens(spans, whatsAppMention, func(match []string) richSpan {
+		name := match[1]
+		if contact, ok := w.conn.Store.Contacts[match[1]+"@s.whatsapp.net"]; ok && contact.Name != "" {
+			name = contact.Name
 		}
+		return richSpan{text: "@" + name, mention: true}
+	})
+}
+
+// mentionsMe returns true if a message @mentions our number or quotes one of our messages.
+func (w *whatsApp) mentionsMe(m whatsapp.TextMessage) bool {
+	if m.Info.FromMe {
+		return false
 	}
-	ch.messages = append(ch.messages, msg)
 
-	if ch == w.ui.currentChannel {
-		w.ui.appendMessages([]*message{msg})
+	me := w.conn.Info.Wid
+	if m.ContextInfo.Participant == me {
+		return true
+	}
+	number := strings.Split(me, "@")[0]
+	return number != "" && strings.Contains(m.Text, "@"+number)
+}
+
+// whatsAppTextProto builds a text message, listing the people it mentions so that they are notified.
+// The library's TextMessage cannot carry mentions so we fill in the message ourselves.
+func whatsAppTextProto(jid, text string, mentioned []string) *proto.WebMessageInfo {
+	b := make([]byte, 10)
+	_, _ = rand.Read(b)
+	id := strings.ToUpper(hex.EncodeToString(b))
+	fromMe := true
+	stamp := uint64(time.Now().Unix())
+	status := proto.WebMessageInfo_PENDING
+
+	msg := &proto.Message{Conversation: &text}
+	if len(mentioned) > 0 {
+		msg = &proto.Message{ExtendedTextMessage: &proto.ExtendedTextMessage{Text: &text,
+			ContextInfo: &proto.ContextInfo{MentionedJid: mentioned}}}
+	}
+	return &proto.WebMessageInfo{Key: &proto.MessageKey{FromMe: &fromMe, RemoteJid: &jid, Id: &id},
+		MessageTimestamp: &stamp, Status: &status, Message: msg}
+}
+
+// whatsAppError marks errors caused by the phone removing our session so that we stop trying to reconnect.
+func whatsAppError(err error) error {
+	msg := err.Error()
+	if errors.Is(err, whatsapp.ErrInvalidSession) || (strings.Contains(msg, "responded with") &&
+		(strings.Contains(msg, "401") || strings.Contains(msg, "403") || strings.Contains(msg, "419"))) {
+		return fmt.Errorf("%w: %v", errAuthRequired, err)
 	}
+	return err
 }
 
 var userLock sync.RWMutex
@@ -186,7 +593,7 @@ func (w *whatsApp) getUser(id string) *user {
 		return usr
 	}
 
-	user := &user{name: "someone",
+	user := &user{id: id, name: "someone",
 		username: id}
 
 	if contact, ok := w.conn.Store.Contacts[id]; ok {